@@ -1,13 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
+	"github.com/sumanthd032/lancrypt/internal/daemon"
+	"github.com/sumanthd032/lancrypt/internal/discovery"
+	"github.com/sumanthd032/lancrypt/internal/rendezvous"
 	"github.com/sumanthd032/lancrypt/internal/transfer"
+	"github.com/sumanthd032/lancrypt/pkg/crypto"
 )
 
+// exitExpired is the exit status of a sender whose code expired before a receiver
+// connected, so scripts can tell it apart from a failed transfer.
+const exitExpired = 3
+
+// exitCancelled is the exit status after Ctrl-C, as shells report for SIGINT.
+const exitCancelled = 130
+
 var rootCmd = &cobra.Command{
 	Use:   "lancrypt",
 	Short: "LanCrypt is a tool for secure, peer-to-peer file sharing on a local network.",
@@ -19,22 +35,86 @@ over a local network, with no databases, no cloud, and no persistence.`,
 }
 
 var sendCmd = &cobra.Command{
-	Use:   "send [file]",
-	Short: "Send a file to a peer on the local network",
-	Long:  `Encrypts and sends a file to a receiving peer. It will generate a transfer code for the receiver to use.`,
-	Args:  cobra.ExactArgs(1),
+	Use:   "send [file|directory|glob|-]...",
+	Short: "Send files or directories to a peer on the local network",
+	Long: `Encrypts and sends one or more files to a receiving peer over a single session.
+Directories are sent recursively and rebuilt on the receiving side, and glob patterns
+are expanded. Pass - to send standard input as a stream of unknown size, or --text
+to send a short text snippet without writing it to disk. It will generate a transfer
+code for the receiver to use.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("text") && len(args) > 0 {
+			return fmt.Errorf("--text can't be combined with files")
+		}
+		if cmd.Flags().Changed("text") {
+			return nil
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		filePath := args[0]
 		passphrase, _ := cmd.Flags().GetString("passphrase")
+		pad, _ := cmd.Flags().GetBool("pad")
+		pake, _ := cmd.Flags().GetBool("pake")
+		streams, _ := cmd.Flags().GetInt("streams")
+		if streams < 1 || streams > transfer.MaxStreams {
+			fmt.Fprintf(os.Stderr, "Error: --streams must be between 1 and %d\n", transfer.MaxStreams)
+			os.Exit(1)
+		}
+		compressFlag, _ := cmd.Flags().GetString("compress")
+		compress, err := transfer.ParseCompressionMode(compressFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
-		sender, err := transfer.NewSender(filePath, passphrase)
+		var sender *transfer.Sender
+		if cmd.Flags().Changed("text") {
+			text, _ := cmd.Flags().GetString("text")
+			sender, err = transfer.NewTextSender(text, passphrase)
+		} else {
+			sender, err = transfer.NewSender(args, passphrase)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating sender: %v\n", err)
 			os.Exit(1)
 		}
 		defer sender.Close()
+		sender.Pad = pad
+		sender.PAKE = pake
+		sender.Streams = streams
+		sender.Compress = compress
+		if sender.RendezvousPort, err = portFlag(cmd, "rendezvous-port"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		sender.DaemonSocket, _ = cmd.Flags().GetString("daemon-socket")
+		if sender.TTL, _ = cmd.Flags().GetDuration("ttl"); sender.TTL < 0 {
+			fmt.Fprintln(os.Stderr, "Error: --ttl can't be negative")
+			os.Exit(1)
+		}
+		if sender.Argon2, err = argon2Params(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if sender.Argon2Limit, err = argon2Limit(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if sender.ChunkSize, err = chunkSize(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
-		if err := sender.Start(); err != nil {
+		if err := sender.StartContext(interruptContext()); err != nil {
+			if errors.Is(err, context.Canceled) {
+				fmt.Fprintln(os.Stderr, "⛔ Transfer cancelled.")
+				os.Exit(exitCancelled)
+			}
+			if errors.Is(err, transfer.ErrExpired) {
+				fmt.Fprintln(os.Stderr, "⌛ The transfer code expired before a receiver connected.")
+				os.Exit(exitExpired)
+			}
 			fmt.Fprintf(os.Stderr, "Error during transfer: %v\n", err)
 			os.Exit(1)
 		}
@@ -44,35 +124,227 @@ var sendCmd = &cobra.Command{
 var recvCmd = &cobra.Command{
 	Use:   "recv",
 	Short: "Receive a file from a peer on the local network",
-	Long:  `Receives a file from a sending peer using a transfer code, discovered automatically on the LAN.`,
+	Long: `Receives a file from a sending peer using a transfer code, discovered automatically on the LAN.
+With --stdout, a single incoming file is written to standard output for use in a pipe.
+Text snippets are printed, unless --save asks for them to be written to a file.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		code, _ := cmd.Flags().GetString("code")
 		passphrase, _ := cmd.Flags().GetString("passphrase")
+		outDir, _ := cmd.Flags().GetString("out")
+		onConflict, _ := cmd.Flags().GetString("on-conflict")
+		autoAccept, _ := cmd.Flags().GetBool("yes")
+		stdout, _ := cmd.Flags().GetBool("stdout")
+		saveText, _ := cmd.Flags().GetBool("save")
+		host, _ := cmd.Flags().GetString("host")
+		port, err := portFlag(cmd, "port")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if port != 0 && host == "" {
+			fmt.Fprintln(os.Stderr, "Error: --port needs --host")
+			os.Exit(1)
+		}
+		rendezvousPort, err := portFlag(cmd, "rendezvous-port")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		policy, err := transfer.ParseConflictPolicy(onConflict)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
 		receiver, err := transfer.NewReceiver(code, passphrase)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating receiver: %v\n", err)
 			os.Exit(1)
 		}
+		receiver.OutDir = outDir
+		receiver.OnConflict = policy
+		receiver.AutoAccept = autoAccept
+		receiver.Stdout = stdout
+		receiver.SaveText = saveText
+		receiver.Host = host
+		receiver.Port = port
+		receiver.RendezvousPort = rendezvousPort
+		if receiver.Argon2, err = argon2Params(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if receiver.Argon2Limit, err = argon2Limit(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 
-		if err := receiver.Connect(); err != nil {
+		if receiver.ChunkSize, err = chunkSize(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if receiver.BrowseTimeout, _ = cmd.Flags().GetDuration("browse-timeout"); receiver.BrowseTimeout <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: --browse-timeout must be positive")
+			os.Exit(1)
+		}
+
+		if err := receiver.ConnectContext(interruptContext()); err != nil {
+			if errors.Is(err, context.Canceled) {
+				fmt.Fprintln(os.Stderr, "⛔ Transfer cancelled.")
+				os.Exit(exitCancelled)
+			}
 			fmt.Fprintf(os.Stderr, "Error during transfer: %v\n", err)
 			os.Exit(1)
 		}
 	},
 }
 
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run a shared rendezvous server and mDNS responder for local senders",
+	Long: `Runs a single long-lived rendezvous server and mDNS responder. Senders on this
+machine register their codes with it over a Unix socket instead of starting their own,
+so many transfers can be served at once. A code is withdrawn when its sender exits, or
+when it expires.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, _ := cmd.Flags().GetString("socket")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		if ttl <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: --ttl must be positive")
+			os.Exit(1)
+		}
+
+		d := daemon.NewDaemon(socket)
+		d.MaxTTL = ttl
+		var err error
+		if d.RendezvousPort, err = portFlag(cmd, "rendezvous-port"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := d.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running daemon: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// interruptContext returns a context that is cancelled by Ctrl-C or SIGTERM, so a
+// transfer can tell the peer and clean up before the process exits. A second signal
+// kills the process as usual.
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx
+}
+
+// addArgon2Flags registers the passphrase-stretching cost flags on a command.
+func addArgon2Flags(cmd *cobra.Command) {
+	defaults := crypto.DefaultArgon2Params
+	cmd.Flags().Uint32("argon-time", defaults.Time, "Argon2id passes used to stretch the passphrase")
+	cmd.Flags().Uint32("argon-memory", defaults.MemoryKiB/1024, "Argon2id memory in MiB used to stretch the passphrase")
+	cmd.Flags().Uint8("argon-threads", defaults.Threads, "Argon2id parallelism used to stretch the passphrase")
+
+	limit := crypto.DefaultArgon2Limit
+	cmd.Flags().Uint32("argon-max-time", limit.Time, "Highest Argon2id passes the peer may ask for")
+	cmd.Flags().Uint32("argon-max-memory", limit.MemoryKiB/1024, "Highest Argon2id memory in MiB the peer may ask for")
+	cmd.Flags().Uint8("argon-max-threads", limit.Threads, "Highest Argon2id parallelism the peer may ask for")
+}
+
+// argon2Params reads the passphrase-stretching cost flags. The peers use the
+// stronger of their two settings.
+func argon2Params(cmd *cobra.Command) (crypto.Argon2Params, error) {
+	time, _ := cmd.Flags().GetUint32("argon-time")
+	threads, _ := cmd.Flags().GetUint8("argon-threads")
+	memory, err := memoryKiB(cmd, "argon-memory")
+	if err != nil {
+		return crypto.Argon2Params{}, err
+	}
+
+	params := crypto.Argon2Params{Time: time, MemoryKiB: memory, Threads: threads}
+	return params, params.Validate()
+}
+
+// argon2Limit reads the flags that cap the passphrase-stretching cost the peer may ask
+// for, since it asks before it has proven anything.
+func argon2Limit(cmd *cobra.Command) (crypto.Argon2Params, error) {
+	time, _ := cmd.Flags().GetUint32("argon-max-time")
+	threads, _ := cmd.Flags().GetUint8("argon-max-threads")
+	memory, err := memoryKiB(cmd, "argon-max-memory")
+	if err != nil {
+		return crypto.Argon2Params{}, err
+	}
+
+	limit := crypto.Argon2Params{Time: time, MemoryKiB: memory, Threads: threads}
+	return limit, limit.Validate()
+}
+
+// memoryKiB reads a memory flag given in MiB. A value too large to count in KiB is
+// refused here, before it could wrap around into one that Validate accepts.
+func memoryKiB(cmd *cobra.Command, name string) (uint32, error) {
+	mib, _ := cmd.Flags().GetUint32(name)
+	if mib > math.MaxUint32/1024 {
+		return 0, fmt.Errorf("--%s of %d MiB is too large", name, mib)
+	}
+	return mib * 1024, nil
+}
+
+// chunkSize reads the --chunk-size flag, given in KiB. The peers use the smaller of
+// their two settings.
+func chunkSize(cmd *cobra.Command) (int, error) {
+	kib, _ := cmd.Flags().GetInt("chunk-size")
+	return kib * 1024, transfer.CheckChunkSize(kib * 1024)
+}
+
+// portFlag reads a TCP port flag, where 0 means none or any, depending on the flag.
+func portFlag(cmd *cobra.Command, name string) (int, error) {
+	port, _ := cmd.Flags().GetInt(name)
+	if port < 0 || port > 65535 {
+		return 0, fmt.Errorf("--%s must be between 0 and 65535", name)
+	}
+	return port, nil
+}
+
 func init() {
 	// Add passphrase flag to send command
 	sendCmd.Flags().StringP("passphrase", "p", "", "Optional passphrase for extra security")
+	sendCmd.Flags().Bool("pad", false, "Pad file sizes on the wire so exact lengths don't leak")
+	sendCmd.Flags().Bool("pake", false, "Authenticate with a secret code suffix (PAKE) instead of comparing a SAS")
+	sendCmd.Flags().Int("streams", 1, "Number of parallel data connections to use")
+	sendCmd.Flags().String("compress", "auto", "Compress data before encrypting it: auto, zstd or none")
+	sendCmd.Flags().Int("rendezvous-port", rendezvous.DefaultPort, "Port for the rendezvous server (0 picks a free one)")
+	sendCmd.Flags().String("daemon-socket", daemon.DefaultSocketPath(), "Socket of the local daemon to register with, when one is running")
+	sendCmd.Flags().Duration("ttl", 0, "Give up waiting for a receiver after this long, e.g. 10m (0 waits forever)")
+	sendCmd.Flags().String("text", "", "Send a text snippet instead of files (- reads it from standard input)")
 
 	// Add passphrase flag to recv command
 	recvCmd.Flags().StringP("passphrase", "p", "", "Optional passphrase for extra security")
 	recvCmd.Flags().StringP("code", "c", "", "The transfer code from the sender")
+	recvCmd.Flags().StringP("out", "o", ".", "Directory to save received files in")
+	recvCmd.Flags().String("on-conflict", "rename", "What to do when a file already exists: rename, skip, overwrite or prompt")
+	recvCmd.Flags().BoolP("yes", "y", false, "Accept all incoming files without asking")
+	recvCmd.Flags().Bool("stdout", false, "Write the received file to standard output")
+	recvCmd.Flags().Bool("save", false, "Save a received text snippet as a file instead of printing it")
+	recvCmd.Flags().String("host", "", "Sender's address, to skip mDNS discovery")
+	recvCmd.Flags().Int("port", 0, "Sender's data port, to skip the rendezvous lookup as well (needs --host)")
+	recvCmd.Flags().Int("rendezvous-port", rendezvous.DefaultPort, "Sender's rendezvous port, used with --host when --port is not given")
+	recvCmd.Flags().Duration("browse-timeout", discovery.DefaultBrowseTimeout, "How long to look for the sender over mDNS")
 	recvCmd.MarkFlagRequired("code")
 
+	addArgon2Flags(sendCmd)
+	addArgon2Flags(recvCmd)
+	sendCmd.Flags().Int("chunk-size", transfer.DefaultChunkSize/1024, "Largest chunk size in KiB (64 to 4096)")
+	recvCmd.Flags().Int("chunk-size", transfer.DefaultChunkSize/1024, "Largest chunk size in KiB (64 to 4096)")
+
 	rootCmd.AddCommand(sendCmd)
 	rootCmd.AddCommand(recvCmd)
+
+	daemonCmd.Flags().String("socket", daemon.DefaultSocketPath(), "Unix socket senders register at")
+	daemonCmd.Flags().Int("rendezvous-port", rendezvous.DefaultPort, "Port for the rendezvous server (0 picks a free one)")
+	daemonCmd.Flags().Duration("ttl", daemon.DefaultMaxTTL, "Longest a code stays registered")
+	rootCmd.AddCommand(daemonCmd)
 }
 
 func main() {
@@ -2,18 +2,23 @@ module github.com/sumanthd032/lancrypt
 
 go 1.24.5
 
+require (
+	filippo.io/edwards25519 v1.2.0
+	github.com/grandcat/zeroconf v1.0.0
+	github.com/klauspost/compress v1.18.0
+	github.com/miekg/dns v1.1.27
+	github.com/schollz/progressbar/v3 v3.18.0
+	github.com/spf13/cobra v1.9.1
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.42.0
+)
+
 require (
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
-	github.com/grandcat/zeroconf v1.0.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/miekg/dns v1.1.27 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/progressbar/v3 v3.18.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
 	github.com/spf13/pflag v1.0.7 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
-	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/term v0.34.0 // indirect
 )
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Client is a sender's connection to a running daemon. Closing it withdraws every
+// code registered through it.
+type Client struct {
+	conn      net.Conn
+	responses chan response
+	expired   chan string
+}
+
+// Dial connects to the daemon listening on socketPath. It fails if no daemon is running.
+func Dial(socketPath string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, responses: make(chan response), expired: make(chan string, 16)}
+	go c.receive()
+	return c, nil
+}
+
+// Expired delivers the codes the daemon withdrew because they expired.
+func (c *Client) Expired() <-chan string {
+	return c.expired
+}
+
+// Register asks the daemon to answer for code, pointing receivers at the given data
+// port. A ttl of zero keeps the code for as long as the daemon allows, and parts of
+// a second count as a whole one. Registering a code again once a receiver has looked it up makes it resolvable again.
+func (c *Client) Register(code, port string, ttl time.Duration) error {
+	return c.call(request{Op: opRegister, Code: code, Port: port, TTL: int((ttl + time.Second - 1) / time.Second)})
+}
+
+// Consume reports that a receiver connected after looking up code, so the daemon
+// does not hand the code out again.
+func (c *Client) Consume(code string) error {
+	return c.call(request{Op: opConsume, Code: code})
+}
+
+// Deregister withdraws a code registered through this client.
+func (c *Client) Deregister(code string) error {
+	return c.call(request{Op: opDeregister, Code: code})
+}
+
+// Close disconnects from the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// call sends a request and waits for the daemon's answer.
+func (c *Client) call(req request) error {
+	line, _ := json.Marshal(req)
+	if _, err := c.conn.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not reach the daemon: %w", err)
+	}
+	resp, ok := <-c.responses
+	if !ok {
+		return fmt.Errorf("the daemon closed the connection")
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("the daemon refused the request: %s", resp.Error)
+	}
+	return nil
+}
+
+// receive reads everything the daemon sends, passing answers on to call and notices
+// of expired codes to Expired.
+func (c *Client) receive() {
+	defer close(c.expired)
+	defer close(c.responses)
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			resp.Error = fmt.Sprintf("could not decode the daemon's answer: %v", err)
+		}
+		if resp.Expired != "" {
+			select {
+			case c.expired <- resp.Expired:
+			default:
+			}
+			continue
+		}
+		c.responses <- resp
+	}
+}
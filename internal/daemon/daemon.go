@@ -0,0 +1,296 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sumanthd032/lancrypt/internal/discovery"
+	"github.com/sumanthd032/lancrypt/internal/rendezvous"
+)
+
+// DefaultMaxTTL is how long a code stays registered unless the sender asks for less.
+const DefaultMaxTTL = time.Hour
+
+// Operations a sender can ask the daemon for.
+const (
+	opRegister   = "register"
+	opDeregister = "deregister"
+	opConsume    = "consume"
+)
+
+// request is one line a sender writes to the daemon's socket.
+type request struct {
+	Op   string `json:"op"`
+	Code string `json:"code"`
+	Port string `json:"port,omitempty"` // Data port the code leads to.
+	TTL  int    `json:"ttl,omitempty"`  // Seconds until the code expires; 0 for the daemon's maximum.
+}
+
+// response answers every request. The daemon also sends one on its own, naming the
+// code in Expired, when a code expires.
+type response struct {
+	Error   string `json:"error,omitempty"`
+	Expired string `json:"expired,omitempty"`
+}
+
+// DefaultSocketPath returns where the daemon listens for local senders. The runtime
+// directory is private to the user; the cache directory serves where there is none.
+func DefaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "lancrypt.sock")
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "lancrypt", "daemon.sock")
+}
+
+// advertiser publishes codes on the local network; a discovery.Responder outside of tests.
+type advertiser interface {
+	Add(instance string)
+	Remove(instance string)
+}
+
+// registration is a code the daemon answers for.
+type registration struct {
+	expiry *time.Timer
+}
+
+// Daemon runs one rendezvous server and mDNS responder for every sender on the machine.
+// Senders register their codes over a Unix socket; a code is withdrawn when its sender
+// deregisters it or disconnects, or when it expires.
+type Daemon struct {
+	SocketPath     string
+	RendezvousPort int           // Port for the rendezvous server; 0 picks a free one.
+	MaxTTL         time.Duration // Longest a code may stay registered.
+
+	rvServer *rendezvous.Server
+	mdns     advertiser
+	mu       sync.Mutex
+	codes    map[string]*registration
+}
+
+// NewDaemon prepares a daemon listening on the given socket.
+func NewDaemon(socketPath string) *Daemon {
+	return &Daemon{
+		SocketPath:     socketPath,
+		RendezvousPort: rendezvous.DefaultPort,
+		MaxTTL:         DefaultMaxTTL,
+		codes:          make(map[string]*registration),
+	}
+}
+
+// Run serves senders until the process is interrupted.
+func (d *Daemon) Run() error {
+	listener, err := d.listen()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(d.SocketPath)
+
+	d.rvServer = rendezvous.NewServer(d.RendezvousPort)
+	if err := d.rvServer.Start(); err != nil {
+		listener.Close()
+		return err
+	}
+	defer d.rvServer.Stop()
+
+	responder, err := discovery.NewResponder(d.rvServer.Port())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	defer responder.Shutdown()
+	d.mdns = responder
+	defer d.withdrawAll()
+
+	fmt.Fprintf(os.Stderr, "✅ Daemon is ready.\nRendezvous server on port %d, senders register at %s\n", d.rvServer.Port(), d.SocketPath)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Fprintln(os.Stderr, "Daemon stopped.")
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go d.serve(conn)
+	}
+}
+
+// listen opens the socket. A socket left behind by a daemon that died is replaced,
+// but one that still answers belongs to a running daemon.
+func (d *Daemon) listen() (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(d.SocketPath), 0o700); err != nil {
+		return nil, fmt.Errorf("could not create socket directory: %w", err)
+	}
+	if conn, err := net.Dial("unix", d.SocketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already running at %s", d.SocketPath)
+	}
+	os.Remove(d.SocketPath)
+
+	listener, err := net.Listen("unix", d.SocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", d.SocketPath, err)
+	}
+	if err := os.Chmod(d.SocketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not restrict socket permissions: %w", err)
+	}
+	return listener, nil
+}
+
+// serve handles the requests of one sender. Codes are tied to the connection they
+// were registered on, so a sender that exits without deregistering leaves nothing
+// behind.
+func (d *Daemon) serve(conn net.Conn) {
+	defer conn.Close()
+
+	owned := make(map[string]bool)
+	defer func() {
+		for code := range owned {
+			d.withdraw(code, "sender disconnected")
+		}
+	}()
+
+	// Expiry notices are written from timers, alongside the answers to requests.
+	var writeMu sync.Mutex
+	encoder := json.NewEncoder(conn)
+	send := func(resp response) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return encoder.Encode(resp)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req request
+		var err error
+		if err = json.Unmarshal(scanner.Bytes(), &req); err == nil {
+			switch req.Op {
+			case opRegister:
+				if owned[req.Code] {
+					err = d.renew(req)
+				} else if err = d.register(req, func() { send(response{Expired: req.Code}) }); err == nil {
+					owned[req.Code] = true
+				}
+			case opConsume:
+				if !owned[req.Code] {
+					err = fmt.Errorf("code %q is not registered on this connection", req.Code)
+				} else {
+					d.rvServer.Consume(req.Code)
+				}
+			case opDeregister:
+				if !owned[req.Code] {
+					err = fmt.Errorf("code %q is not registered on this connection", req.Code)
+				} else {
+					delete(owned, req.Code)
+					d.withdraw(req.Code, "deregistered")
+				}
+			default:
+				err = fmt.Errorf("unknown operation %q", req.Op)
+			}
+		}
+
+		var resp response
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if send(resp) != nil {
+			return
+		}
+	}
+}
+
+// register makes a code resolvable and advertises it over mDNS until it expires, when
+// expired is called.
+func (d *Daemon) register(req request, expired func()) error {
+	if req.Code == "" {
+		return fmt.Errorf("missing code")
+	}
+	if port, err := strconv.Atoi(req.Port); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", req.Port)
+	}
+	ttl := d.MaxTTL
+	if req.TTL > 0 {
+		ttl = min(ttl, time.Duration(req.TTL)*time.Second)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.codes[req.Code]; ok {
+		return fmt.Errorf("code %q is already registered", req.Code)
+	}
+	d.rvServer.Register(req.Code, req.Port)
+	d.mdns.Add(req.Code)
+	d.codes[req.Code] = &registration{
+		expiry: time.AfterFunc(ttl, func() {
+			if d.withdraw(req.Code, "expired") {
+				expired()
+			}
+		}),
+	}
+	fmt.Fprintf(os.Stderr, "📥 Registered %s (port %s, expires in %s)\n", req.Code, req.Port, ttl)
+	return nil
+}
+
+// renew makes a code resolvable again after a receiver has looked it up. The code
+// keeps its mDNS service and its expiry.
+func (d *Daemon) renew(req request) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.codes[req.Code]; !ok {
+		return fmt.Errorf("code %q has expired", req.Code)
+	}
+	d.rvServer.Register(req.Code, req.Port)
+	return nil
+}
+
+// withdraw stops answering for a code. It reports whether the code was registered.
+func (d *Daemon) withdraw(code, reason string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reg, ok := d.codes[code]
+	if !ok {
+		return false
+	}
+	delete(d.codes, code)
+	reg.expiry.Stop()
+	d.mdns.Remove(code)
+	d.rvServer.Deregister(code)
+	fmt.Fprintf(os.Stderr, "📤 Withdrew %s (%s)\n", code, reason)
+	return true
+}
+
+// withdrawAll withdraws every code when the daemon shuts down.
+func (d *Daemon) withdrawAll() {
+	d.mu.Lock()
+	codes := make([]string, 0, len(d.codes))
+	for code := range d.codes {
+		codes = append(codes, code)
+	}
+	d.mu.Unlock()
+	for _, code := range codes {
+		d.withdraw(code, "daemon stopped")
+	}
+}
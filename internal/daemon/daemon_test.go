@@ -0,0 +1,228 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumanthd032/lancrypt/internal/rendezvous"
+)
+
+// recorder stands in for the mDNS responder and remembers what is advertised.
+type recorder struct {
+	mu        sync.Mutex
+	instances []string
+}
+
+func (r *recorder) Add(instance string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.instances = append(r.instances, instance)
+}
+
+func (r *recorder) Remove(instance string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.instances = slices.DeleteFunc(r.instances, func(s string) bool { return s == instance })
+}
+
+func (r *recorder) advertised(instance string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Contains(r.instances, instance)
+}
+
+// startDaemon serves senders on a temporary socket, with a rendezvous server on a free
+// port and no multicast.
+func startDaemon(t *testing.T) (*Daemon, *recorder) {
+	t.Helper()
+	silence(t)
+	d := NewDaemon(filepath.Join(t.TempDir(), "daemon.sock"))
+	d.MaxTTL = time.Minute
+	listener, err := d.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.rvServer = rendezvous.NewServer(0)
+	if err := d.rvServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	mdns := &recorder{}
+	d.mdns = mdns
+	t.Cleanup(func() {
+		listener.Close()
+		d.withdrawAll()
+		d.rvServer.Stop()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d, mdns
+}
+
+// silence hides the daemon's status lines for the rest of a test.
+func silence(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = devNull
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		devNull.Close()
+	})
+}
+
+// dial connects a client to the daemon.
+func dial(t *testing.T, d *Daemon) *Client {
+	t.Helper()
+	client, err := Dial(d.SocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// lookup asks the daemon's rendezvous server for a code, as a receiver would, and
+// returns the port it hands out, or "" if it refuses.
+func lookup(t *testing.T, d *Daemon, code string) string {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/%s", d.rvServer.Port(), code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// eventually waits up to a second for cond to hold.
+func eventually(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting until %s", what)
+}
+
+// TestRegisterRenewConsume walks a code through its life on the daemon: registered,
+// looked up once, renewed, consumed and deregistered.
+func TestRegisterRenewConsume(t *testing.T) {
+	d, mdns := startDaemon(t)
+	client := dial(t, d)
+
+	if err := client.Register("maple-otter", "4242", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !mdns.advertised("maple-otter") {
+		t.Error("registered code is not advertised")
+	}
+	if got := lookup(t, d, "maple-otter"); got != "4242" {
+		t.Fatalf("first lookup = %q, want 4242", got)
+	}
+	if got := lookup(t, d, "maple-otter"); got != "" {
+		t.Fatalf("second lookup = %q, want a refusal", got)
+	}
+
+	// Renewing makes the code resolvable again, for the real receiver.
+	if err := client.Register("maple-otter", "4242", 0); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if got := lookup(t, d, "maple-otter"); got != "4242" {
+		t.Fatalf("lookup after renewal = %q, want 4242", got)
+	}
+	if err := client.Consume("maple-otter"); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if got := lookup(t, d, "maple-otter"); got != "" {
+		t.Fatalf("lookup after consume = %q, want a refusal", got)
+	}
+
+	if err := client.Deregister("maple-otter"); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if mdns.advertised("maple-otter") {
+		t.Error("deregistered code is still advertised")
+	}
+	if err := client.Consume("maple-otter"); err == nil {
+		t.Error("consuming a deregistered code succeeded")
+	}
+}
+
+// TestCodesBelongToTheirSender checks that one sender can't take over, consume or
+// withdraw another's code, and that a code goes away with its sender.
+func TestCodesBelongToTheirSender(t *testing.T) {
+	d, mdns := startDaemon(t)
+	owner, other := dial(t, d), dial(t, d)
+
+	if err := owner.Register("maple-otter", "4242", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Register("maple-otter", "6666", 0); err == nil {
+		t.Error("registering a taken code succeeded")
+	}
+	if err := other.Consume("maple-otter"); err == nil {
+		t.Error("consuming another sender's code succeeded")
+	}
+	if err := other.Deregister("maple-otter"); err == nil {
+		t.Error("deregistering another sender's code succeeded")
+	}
+	if err := other.Register("tiger-plum", "0", 0); err == nil {
+		t.Error("registering an invalid port succeeded")
+	}
+
+	owner.Close()
+	eventually(t, func() bool { return !mdns.advertised("maple-otter") }, "the code of a disconnected sender is withdrawn")
+	if got := lookup(t, d, "maple-otter"); got != "" {
+		t.Errorf("lookup after the sender left = %q, want a refusal", got)
+	}
+}
+
+// TestExpiryNotifiesSender checks that a code is withdrawn once its TTL has passed and
+// that its sender hears about it. Parts of a second must not be read as "no TTL".
+func TestExpiryNotifiesSender(t *testing.T) {
+	d, mdns := startDaemon(t)
+	client := dial(t, d)
+
+	if err := client.Register("maple-otter", "4242", 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-client.Expired():
+		if code != "maple-otter" {
+			t.Errorf("expired code = %q, want maple-otter", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no expiry notice within 3s")
+	}
+	if mdns.advertised("maple-otter") {
+		t.Error("expired code is still advertised")
+	}
+	if got := lookup(t, d, "maple-otter"); got != "" {
+		t.Errorf("lookup after expiry = %q, want a refusal", got)
+	}
+	// The notice must not be mistaken for the answer to a later request.
+	if err := client.Register("maple-otter", "4242", 0); err == nil {
+		t.Error("renewing an expired code succeeded")
+	}
+}
@@ -2,8 +2,11 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"slices"
 	"time"
 
 	"github.com/grandcat/zeroconf"
@@ -30,19 +33,57 @@ func PublishService(instance string, port int) (*zeroconf.Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not register mDNS service: %w", err)
 	}
-	fmt.Printf("mDNS service '%s' published on port %d\n", instance, port)
+	fmt.Fprintf(os.Stderr, "mDNS service '%s' published on port %d\n", instance, port)
 	return server, nil
 }
 
+// LocalAddresses returns the unicast addresses of every network interface that is up,
+// so they can be given to a peer by hand when multicast does not get through.
+func LocalAddresses() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list network interfaces: %w", err)
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// DefaultBrowseTimeout is how long DiscoverService looks for a sender.
+const DefaultBrowseTimeout = 5 * time.Second
+
 // DiscoverService browses the network to find a LanCrypt service with a specific instance name.
+// The entry it returns carries every IPv4 and IPv6 address the service advertised.
 func DiscoverService(instance string) (*zeroconf.ServiceEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultBrowseTimeout)
+	defer cancel()
+	return DiscoverServiceContext(ctx, instance)
+}
+
+// DiscoverServiceContext is like DiscoverService, but browses until ctx is done, so the
+// caller decides how long to look and can stop early.
+func DiscoverServiceContext(ctx context.Context, instance string) (*zeroconf.ServiceEntry, error) {
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize mDNS resolver: %w", err)
 	}
 
 	entries := make(chan *zeroconf.ServiceEntry)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5) // 5-second timeout
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// The Browse function now takes the channel as an argument.
@@ -54,30 +95,88 @@ func DiscoverService(instance string) (*zeroconf.ServiceEntry, error) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, fmt.Errorf("could not find sender '%s' on the network (timeout)", instance)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("could not find sender '%s' on the network (timeout)", instance)
+			}
+			return nil, ctx.Err()
 		case entry := <-entries:
 			if entry.Instance == instance {
 				// We found our specific instance.
-				var ipv4 net.IP
-				for _, addr := range entry.AddrIPv4 {
-					// Prefer a non-loopback, global unicast address.
-					if addr.IsGlobalUnicast() && !addr.IsLoopback() {
-						ipv4 = addr
-						break
-					}
-				}
-				if ipv4 == nil && len(entry.AddrIPv4) > 0 {
-					// Fallback to the first available IPv4 address if no ideal one is found.
-					ipv4 = entry.AddrIPv4[0]
+				if len(entry.AddrIPv4) == 0 && len(entry.AddrIPv6) == 0 {
+					return nil, fmt.Errorf("found sender but it has no usable address")
 				}
-
-				if ipv4 == nil {
-					return nil, fmt.Errorf("found sender but it has no usable IPv4 address")
-				}
-				// Replace the IP in the entry for consistency.
-				entry.AddrIPv4 = []net.IP{ipv4}
 				return entry, nil
 			}
 		}
 	}
+}
+
+// Candidates lists the hosts a service can be reached at, in the order they should be
+// tried: global addresses before link-local and loopback ones, alternating between
+// IPv6 and IPv4 as Happy Eyeballs recommends. A link-local IPv6 address is only
+// reachable through the right interface, which mDNS doesn't say, so it is listed with
+// the zone of every interface that could lead there.
+func Candidates(entry *zeroconf.ServiceEntry) []string {
+	rank := func(a, b net.IP) int { return addressRank(a) - addressRank(b) }
+	v6 := slices.SortedStableFunc(slices.Values(entry.AddrIPv6), rank)
+	v4 := slices.SortedStableFunc(slices.Values(entry.AddrIPv4), rank)
+
+	var hosts6 []string
+	for _, ip := range v6 {
+		if !ip.IsLinkLocalUnicast() {
+			hosts6 = append(hosts6, ip.String())
+			continue
+		}
+		for _, zone := range linkLocalZones() {
+			hosts6 = append(hosts6, ip.String()+"%"+zone)
+		}
+	}
+
+	var hosts []string
+	for i := range max(len(hosts6), len(v4)) {
+		if i < len(hosts6) {
+			hosts = append(hosts, hosts6[i])
+		}
+		if i < len(v4) {
+			hosts = append(hosts, v4[i].String())
+		}
+	}
+	return hosts
+}
+
+// addressRank orders addresses by how likely they are to reach another machine.
+func addressRank(ip net.IP) int {
+	switch {
+	case ip.IsLoopback():
+		return 2
+	case ip.IsLinkLocalUnicast():
+		return 1
+	}
+	return 0
+}
+
+// linkLocalZones names the interfaces that are up and have an IPv6 link-local address.
+func linkLocalZones() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var zones []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				zones = append(zones, iface.Name)
+				break
+			}
+		}
+	}
+	return zones
 }
\ No newline at end of file
@@ -0,0 +1,462 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The multicast groups and port of mDNS (RFC 6762).
+var (
+	mdnsGroupIPv4 = net.IPv4(224, 0, 0, 251)
+	mdnsGroupIPv6 = net.ParseIP("ff02::fb")
+)
+
+const mdnsPort = 5353
+
+// recordTTL is how long, in seconds, peers may cache the records of a service. RFC 6762
+// recommends 120 for records that name host addresses, which can change.
+const recordTTL = 120
+
+// classUnicast is the top bit of a question's class, which asks for a unicast answer,
+// and of a record's class in a response, which tells peers to flush older copies.
+const classUnicast = 1 << 15
+
+// serviceText is the TXT record every LanCrypt service carries.
+var serviceText = []string{"txtv=0", "lo=1", "la=2"}
+
+// Responder answers mDNS queries for any number of LanCrypt services on this host, all
+// pointing at the same rendezvous port. Services come and go while it runs, so a
+// daemon serving many senders needs only one set of multicast sockets.
+type Responder struct {
+	port   int
+	host   string // This host's name in the mDNS domain.
+	ifaces []net.Interface
+	conn4  *ipv4.PacketConn
+	conn6  *ipv6.PacketConn
+
+	mu        sync.Mutex
+	instances map[string]bool
+	shutdown  bool // Set by Shutdown, after which nothing new is started.
+	closed    chan struct{}
+	running   sync.WaitGroup
+}
+
+// NewResponder joins the mDNS groups on every multicast interface and starts answering
+// for the services added later. Their SRV records lead to the given rendezvous port.
+func NewResponder(port int) (*Responder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine host name: %w", err)
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	r := &Responder{
+		port:      port,
+		host:      dns.Fqdn(hostname + "." + Domain),
+		ifaces:    multicastInterfaces(),
+		instances: make(map[string]bool),
+		closed:    make(chan struct{}),
+	}
+	conn4, err4 := joinIPv4(r.ifaces)
+	conn6, err6 := joinIPv6(r.ifaces)
+	if err4 != nil && err6 != nil {
+		return nil, fmt.Errorf("could not start mDNS responder: %w", errors.Join(err4, err6))
+	}
+
+	if conn4 != nil {
+		r.conn4 = conn4
+		r.running.Add(1)
+		go r.receive(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := conn4.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, from, err
+			}
+			return n, cm.IfIndex, from, err
+		})
+	}
+	if conn6 != nil {
+		r.conn6 = conn6
+		r.running.Add(1)
+		go r.receive(func(buf []byte) (int, int, net.Addr, error) {
+			n, cm, from, err := conn6.ReadFrom(buf)
+			if cm == nil {
+				return n, 0, from, err
+			}
+			return n, cm.IfIndex, from, err
+		})
+	}
+	return r, nil
+}
+
+// Add advertises a service instance, announcing it right away so browsers that are
+// already looking find it without asking again.
+func (r *Responder) Add(instance string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.shutdown {
+		return
+	}
+	r.instances[instance] = true
+	r.running.Add(1)
+	go r.announce(instance)
+}
+
+// Remove stops advertising a service instance and tells peers to forget it.
+func (r *Responder) Remove(instance string) {
+	r.mu.Lock()
+	known := r.instances[instance]
+	delete(r.instances, instance)
+	r.mu.Unlock()
+
+	if known {
+		r.goodbye(instance)
+	}
+}
+
+// Shutdown withdraws every service and closes the multicast sockets.
+func (r *Responder) Shutdown() {
+	r.mu.Lock()
+	r.shutdown = true
+	instances := slices.Collect(maps.Keys(r.instances))
+	clear(r.instances)
+	r.mu.Unlock()
+
+	for _, instance := range instances {
+		r.goodbye(instance)
+	}
+	close(r.closed)
+	if r.conn4 != nil {
+		r.conn4.Close()
+	}
+	if r.conn6 != nil {
+		r.conn6.Close()
+	}
+	r.running.Wait()
+}
+
+// receive answers the queries read from one socket until it is closed.
+func (r *Responder) receive(read func(buf []byte) (n, ifIndex int, from net.Addr, err error)) {
+	defer r.running.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, from, err := read(buf)
+		if err != nil {
+			return
+		}
+		// Probes carry the records they propose in the authority section. They are
+		// answered like any other query, which tells the prober the name is taken.
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+		for _, q := range query.Question {
+			resp := r.answer(q, &query, ifIndex)
+			if resp == nil {
+				continue
+			}
+			if q.Qclass&classUnicast != 0 {
+				r.unicast(resp, ifIndex, from)
+			} else {
+				r.multicast(resp, ifIndex)
+			}
+		}
+	}
+}
+
+// answer builds the response to one question, or returns nil if it is not ours.
+func (r *Responder) answer(q dns.Question, query *dns.Msg, ifIndex int) *dns.Msg {
+	r.mu.Lock()
+	instances := slices.Sorted(maps.Keys(r.instances))
+	r.mu.Unlock()
+	if len(instances) == 0 {
+		return nil
+	}
+
+	wants := func(rrtype uint16) bool {
+		return q.Qtype == rrtype || q.Qtype == dns.TypeANY
+	}
+	resp := &dns.Msg{Compress: true}
+	resp.Response, resp.Authoritative = true, true
+	switch {
+	case strings.EqualFold(q.Name, serviceTypesName()):
+		if wants(dns.TypePTR) {
+			resp.Answer = append(resp.Answer, ptr(serviceTypesName(), serviceName(), recordTTL))
+		}
+	case strings.EqualFold(q.Name, serviceName()):
+		if !wants(dns.TypePTR) {
+			break
+		}
+		for _, instance := range instances {
+			answer := ptr(serviceName(), instanceName(instance), recordTTL)
+			if !knownAnswer(query, answer) {
+				resp.Answer = append(resp.Answer, answer)
+				resp.Extra = append(resp.Extra, r.srv(instance, recordTTL), txt(instance, recordTTL))
+			}
+		}
+		if len(resp.Answer) > 0 {
+			resp.Extra = append(resp.Extra, r.addresses(ifIndex, recordTTL)...)
+		}
+	case strings.EqualFold(q.Name, r.host):
+		for _, rr := range r.addresses(ifIndex, recordTTL) {
+			if wants(rr.Header().Rrtype) {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	default:
+		for _, instance := range instances {
+			if !strings.EqualFold(q.Name, instanceName(instance)) {
+				continue
+			}
+			if wants(dns.TypeSRV) {
+				resp.Answer = append(resp.Answer, r.srv(instance, recordTTL))
+				resp.Extra = r.addresses(ifIndex, recordTTL)
+			}
+			if wants(dns.TypeTXT) {
+				resp.Answer = append(resp.Answer, txt(instance, recordTTL))
+			}
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	return resp
+}
+
+// announce sends the records of a new service unasked, twice and a second apart as
+// RFC 6762 requires, on every interface with that interface's addresses.
+func (r *Responder) announce(instance string) {
+	defer r.running.Done()
+	for i := range 2 {
+		if i > 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.closed:
+				return
+			}
+		}
+		r.mu.Lock()
+		current := r.instances[instance]
+		r.mu.Unlock()
+		if !current {
+			return
+		}
+		for _, iface := range r.ifaces {
+			resp := &dns.Msg{Compress: true}
+			resp.Response, resp.Authoritative = true, true
+			resp.Answer = append(r.records(instance, recordTTL), r.addresses(iface.Index, recordTTL)...)
+			r.multicast(resp, iface.Index)
+		}
+	}
+}
+
+// goodbye sends the records of a service with a TTL of zero, which tells peers to
+// drop them from their caches.
+func (r *Responder) goodbye(instance string) {
+	resp := &dns.Msg{Compress: true}
+	resp.Response, resp.Authoritative = true, true
+	resp.Answer = r.records(instance, 0)
+	r.multicast(resp, 0)
+}
+
+// records returns the PTR, SRV and TXT records of a service.
+func (r *Responder) records(instance string, ttl uint32) []dns.RR {
+	return []dns.RR{ptr(serviceName(), instanceName(instance), ttl), r.srv(instance, ttl), txt(instance, ttl)}
+}
+
+// srv points a service at this host and the rendezvous port.
+func (r *Responder) srv(instance string, ttl uint32) dns.RR {
+	return &dns.SRV{
+		Hdr:    dns.RR_Header{Name: instanceName(instance), Rrtype: dns.TypeSRV, Class: dns.ClassINET | classUnicast, Ttl: ttl},
+		Port:   uint16(r.port),
+		Target: r.host,
+	}
+}
+
+// addresses returns this host's A and AAAA records for the interface a query came in
+// on, or for every interface when it is not known. Loopback addresses are left out,
+// and link-local IPv6 addresses are only used where there is no global one.
+func (r *Responder) addresses(ifIndex int, ttl uint32) []dns.RR {
+	ifaces := r.ifaces
+	if ifIndex != 0 {
+		if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+			ifaces = []net.Interface{*iface}
+		}
+	}
+
+	var records []dns.RR
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		var v6, v6Local []dns.RR
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			hdr := dns.RR_Header{Name: r.host, Class: dns.ClassINET | classUnicast, Ttl: ttl}
+			switch ip := ipNet.IP; {
+			case ip.To4() != nil:
+				hdr.Rrtype = dns.TypeA
+				records = append(records, &dns.A{Hdr: hdr, A: ip.To4()})
+			case ip.IsGlobalUnicast():
+				hdr.Rrtype = dns.TypeAAAA
+				v6 = append(v6, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			case ip.IsLinkLocalUnicast():
+				hdr.Rrtype = dns.TypeAAAA
+				v6Local = append(v6Local, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		if len(v6) == 0 {
+			v6 = v6Local
+		}
+		records = append(records, v6...)
+	}
+	return records
+}
+
+// multicast sends a response to the mDNS groups on one interface, or on all of them
+// when ifIndex is zero.
+func (r *Responder) multicast(resp *dns.Msg, ifIndex int) {
+	buf, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	indexes := []int{ifIndex}
+	if ifIndex == 0 {
+		indexes = indexes[:0]
+		for _, iface := range r.ifaces {
+			indexes = append(indexes, iface.Index)
+		}
+	}
+	for _, index := range indexes {
+		if r.conn4 != nil {
+			r.conn4.WriteTo(buf, &ipv4.ControlMessage{IfIndex: index}, &net.UDPAddr{IP: mdnsGroupIPv4, Port: mdnsPort})
+		}
+		if r.conn6 != nil {
+			r.conn6.WriteTo(buf, &ipv6.ControlMessage{IfIndex: index}, &net.UDPAddr{IP: mdnsGroupIPv6, Port: mdnsPort})
+		}
+	}
+}
+
+// unicast answers a query that asked for a direct reply.
+func (r *Responder) unicast(resp *dns.Msg, ifIndex int, to net.Addr) {
+	buf, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	addr, ok := to.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	if addr.IP.To4() != nil && r.conn4 != nil {
+		r.conn4.WriteTo(buf, &ipv4.ControlMessage{IfIndex: ifIndex}, addr)
+	} else if addr.IP.To4() == nil && r.conn6 != nil {
+		r.conn6.WriteTo(buf, &ipv6.ControlMessage{IfIndex: ifIndex}, addr)
+	}
+}
+
+// knownAnswer reports whether the querier already holds a record and told us so, in
+// which case RFC 6762 says not to send it again.
+func knownAnswer(query *dns.Msg, rr *dns.PTR) bool {
+	for _, known := range query.Answer {
+		if p, ok := known.(*dns.PTR); ok && strings.EqualFold(p.Ptr, rr.Ptr) && p.Hdr.Ttl >= rr.Hdr.Ttl/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceName is the name browsers ask for to list LanCrypt services.
+func serviceName() string {
+	return dns.Fqdn(ServiceName + "." + Domain)
+}
+
+// serviceTypesName is the name browsers ask for to list every type of service.
+func serviceTypesName() string {
+	return dns.Fqdn("_services._dns-sd._udp." + Domain)
+}
+
+// instanceName is the full name of one service instance.
+func instanceName(instance string) string {
+	return instance + "." + serviceName()
+}
+
+// ptr builds a PTR record from name to target.
+func ptr(name, target string, ttl uint32) *dns.PTR {
+	return &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}, Ptr: target}
+}
+
+// txt builds the TXT record of a service instance.
+func txt(instance string, ttl uint32) dns.RR {
+	return &dns.TXT{Hdr: dns.RR_Header{Name: instanceName(instance), Rrtype: dns.TypeTXT, Class: dns.ClassINET | classUnicast, Ttl: ttl}, Txt: serviceText}
+}
+
+// multicastInterfaces lists the interfaces that are up and can do multicast.
+func multicastInterfaces() []net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ifaces []net.Interface
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces
+}
+
+// joinIPv4 listens for mDNS over IPv4 on every interface that can join the group.
+func joinIPv4(ifaces []net.Interface) (*ipv4.PacketConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(224, 0, 0, 0), Port: mdnsPort})
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv4.NewPacketConn(conn)
+	pc.SetControlMessage(ipv4.FlagInterface, true)
+	joined := 0
+	for i := range ifaces {
+		if pc.JoinGroup(&ifaces[i], &net.UDPAddr{IP: mdnsGroupIPv4}) == nil {
+			joined++
+		}
+	}
+	if joined == 0 {
+		pc.Close()
+		return nil, fmt.Errorf("no interface could join the IPv4 mDNS group")
+	}
+	return pc, nil
+}
+
+// joinIPv6 listens for mDNS over IPv6 on every interface that can join the group.
+func joinIPv6(ifaces []net.Interface) (*ipv6.PacketConn, error) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.ParseIP("ff02::"), Port: mdnsPort})
+	if err != nil {
+		return nil, err
+	}
+	pc := ipv6.NewPacketConn(conn)
+	pc.SetControlMessage(ipv6.FlagInterface, true)
+	joined := 0
+	for i := range ifaces {
+		if pc.JoinGroup(&ifaces[i], &net.UDPAddr{IP: mdnsGroupIPv6}) == nil {
+			joined++
+		}
+	}
+	if joined == 0 {
+		pc.Close()
+		return nil, fmt.Errorf("no interface could join the IPv6 mDNS group")
+	}
+	return pc, nil
+}
@@ -0,0 +1,223 @@
+package discovery
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testResponder answers for the given instances without opening any sockets, and
+// without interfaces, so no address records are added.
+func testResponder(instances ...string) *Responder {
+	r := &Responder{
+		port:      4242,
+		host:      "box.local.",
+		instances: make(map[string]bool),
+		closed:    make(chan struct{}),
+	}
+	for _, instance := range instances {
+		r.instances[instance] = true
+	}
+	return r
+}
+
+// describe summarizes records so tests can compare them at a glance.
+func describe(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			out = append(out, fmt.Sprintf("PTR %s -> %s", rr.Hdr.Name, rr.Ptr))
+		case *dns.SRV:
+			out = append(out, fmt.Sprintf("SRV %s -> %s:%d", rr.Hdr.Name, rr.Target, rr.Port))
+		case *dns.TXT:
+			out = append(out, fmt.Sprintf("TXT %s", rr.Hdr.Name))
+		default:
+			out = append(out, rr.String())
+		}
+	}
+	return out
+}
+
+// TestAnswer checks which records each question gets, and that questions about names
+// or types we don't serve get no answer at all.
+func TestAnswer(t *testing.T) {
+	const service = "_lancrypt._tcp.local."
+	maple := "maple-otter." + service
+	tiger := "tiger-plum." + service
+	knownMaple := func(ttl uint32) []dns.RR { return []dns.RR{ptr(service, maple, ttl)} }
+
+	tests := []struct {
+		name      string
+		instances []string
+		question  dns.Question
+		known     []dns.RR // Answers the querier already holds.
+		answer    []string // Empty if the question must go unanswered.
+		extra     []string
+	}{
+		{
+			name:      "browse",
+			instances: []string{"maple-otter", "tiger-plum"},
+			question:  dns.Question{Name: service, Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+			answer:    []string{"PTR " + service + " -> " + maple, "PTR " + service + " -> " + tiger},
+			extra:     []string{"SRV " + maple + " -> box.local.:4242", "TXT " + maple, "SRV " + tiger + " -> box.local.:4242", "TXT " + tiger},
+		},
+		{
+			name:      "browse with ANY",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: service, Qtype: dns.TypeANY, Qclass: dns.ClassINET},
+			answer:    []string{"PTR " + service + " -> " + maple},
+			extra:     []string{"SRV " + maple + " -> box.local.:4242", "TXT " + maple},
+		},
+		{
+			name:      "browse with mixed case and unicast bit",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: "_LanCrypt._TCP.Local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET | classUnicast},
+			answer:    []string{"PTR " + service + " -> " + maple},
+			extra:     []string{"SRV " + maple + " -> box.local.:4242", "TXT " + maple},
+		},
+		{
+			name:      "known answer suppressed",
+			instances: []string{"maple-otter", "tiger-plum"},
+			question:  dns.Question{Name: service, Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+			known:     knownMaple(recordTTL),
+			answer:    []string{"PTR " + service + " -> " + tiger},
+			extra:     []string{"SRV " + tiger + " -> box.local.:4242", "TXT " + tiger},
+		},
+		{
+			name:      "stale known answer refreshed",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: service, Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+			known:     knownMaple(recordTTL/2 - 1),
+			answer:    []string{"PTR " + service + " -> " + maple},
+			extra:     []string{"SRV " + maple + " -> box.local.:4242", "TXT " + maple},
+		},
+		{
+			name:      "all answers known",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: service, Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+			known:     knownMaple(recordTTL),
+		},
+		{
+			name:      "browse for another type",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: service, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		},
+		{
+			name:      "service types",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: "_services._dns-sd._udp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+			answer:    []string{"PTR _services._dns-sd._udp.local. -> " + service},
+		},
+		{
+			name:      "instance SRV",
+			instances: []string{"maple-otter", "tiger-plum"},
+			question:  dns.Question{Name: maple, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+			answer:    []string{"SRV " + maple + " -> box.local.:4242"},
+		},
+		{
+			name:      "instance TXT",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: maple, Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+			answer:    []string{"TXT " + maple},
+		},
+		{
+			name:      "instance ANY, as in a probe",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: maple, Qtype: dns.TypeANY, Qclass: dns.ClassINET},
+			answer:    []string{"SRV " + maple + " -> box.local.:4242", "TXT " + maple},
+		},
+		{
+			name:      "instance A",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: maple, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		},
+		{
+			name:      "unknown instance",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: "maple-otte." + service, Qtype: dns.TypeSRV, Qclass: dns.ClassINET},
+		},
+		{
+			name:      "other service",
+			instances: []string{"maple-otter"},
+			question:  dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		},
+		{
+			name:     "nothing registered",
+			question: dns.Question{Name: service, Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testResponder(tt.instances...)
+			query := new(dns.Msg)
+			query.Question = []dns.Question{tt.question}
+			query.Answer = tt.known
+
+			resp := r.answer(tt.question, query, 0)
+			if len(tt.answer) == 0 {
+				if resp != nil {
+					t.Fatalf("got answer %q, want none", describe(resp.Answer))
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatalf("got no answer, want %q", tt.answer)
+			}
+			if !resp.Response || !resp.Authoritative {
+				t.Error("response is not marked as an authoritative response")
+			}
+			if got := describe(resp.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			if got := describe(resp.Extra); !slices.Equal(got, tt.extra) {
+				t.Errorf("extra = %q, want %q", got, tt.extra)
+			}
+			if _, err := resp.Pack(); err != nil {
+				t.Errorf("response does not pack: %v", err)
+			}
+		})
+	}
+}
+
+// TestKnownAnswer checks that a record only counts as known when the querier holds it
+// for at least half its lifetime, as RFC 6762 section 7.1 requires.
+func TestKnownAnswer(t *testing.T) {
+	const service = "_lancrypt._tcp.local."
+	record := ptr(service, "maple-otter."+service, recordTTL)
+	tests := []struct {
+		name  string
+		known []dns.RR
+		want  bool
+	}{
+		{"nothing known", nil, false},
+		{"same record", []dns.RR{ptr(service, "maple-otter."+service, recordTTL)}, true},
+		{"case differs", []dns.RR{ptr(service, "Maple-Otter."+service, recordTTL)}, true},
+		{"half the TTL left", []dns.RR{ptr(service, "maple-otter."+service, recordTTL/2)}, true},
+		{"less than half left", []dns.RR{ptr(service, "maple-otter."+service, recordTTL/2-1)}, false},
+		{"other instance", []dns.RR{ptr(service, "tiger-plum."+service, recordTTL)}, false},
+		{"not a PTR", []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "maple-otter." + service, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: recordTTL}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &dns.Msg{Answer: tt.known}
+			if got := knownAnswer(query, record); got != tt.want {
+				t.Errorf("knownAnswer = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAddAfterShutdown checks that a service added while the daemon shuts down is not
+// advertised, and starts nothing that Shutdown would have to wait for.
+func TestAddAfterShutdown(t *testing.T) {
+	r := testResponder("maple-otter")
+	r.Shutdown()
+	r.Add("tiger-plum")
+	if len(r.instances) != 0 {
+		t.Errorf("instances after shutdown: %v", r.instances)
+	}
+	r.running.Wait()
+}
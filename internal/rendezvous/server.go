@@ -2,39 +2,104 @@ package rendezvous
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 )
 
-const RendezvousPort = "13337"
+// DefaultPort is where the rendezvous server listens unless told otherwise. The port
+// actually used is advertised over mDNS, so receivers don't depend on it.
+const DefaultPort = 13337
 
-// Server is a simple HTTP server that maps a code to a port.
+// Limits on lookups from a single IP address. Codes are guessable in principle, so a
+// peer gets a small burst of lookups, then one per lookupInterval, and is locked out
+// for lockoutDuration once it has asked for maxMisses codes that don't exist.
+const (
+	lookupBurst     = 10
+	lookupInterval  = time.Second
+	maxMisses       = 5
+	lockoutDuration = 10 * time.Minute
+)
+
+// maxClients bounds how many addresses are tracked before idle ones are forgotten.
+const maxClients = 1024
+
+// lookupGrace is how long a code that was looked up waits for its receiver to connect.
+// Unless the sender reports a connection by then, the code is handed out again and the
+// lookup counts as a miss, so nobody can keep a code from its receiver by resolving it.
+const lookupGrace = 10 * time.Second
+
+// client tracks the lookups of one IP address.
+type client struct {
+	tokens      float64
+	last        time.Time
+	misses      int
+	lockedUntil time.Time
+}
+
+// hold is a code that was looked up and waits for the sender to confirm a connection.
+type hold struct {
+	port  string
+	ip    string // Address that looked the code up.
+	timer *time.Timer
+}
+
+// Server is a simple HTTP server that maps a code to a port. Every code can be looked
+// up once: whoever resolves it first gets the port, and the code is gone once the
+// sender reports that a receiver connected.
 type Server struct {
 	httpServer *http.Server
+	listener   net.Listener
 	portMap    map[string]string
-	mu         sync.RWMutex
+	held       map[string]*hold
+	clients    map[string]*client
+	mu         sync.Mutex
 }
 
-// NewServer creates a new rendezvous server.
-func NewServer() *Server {
+// NewServer creates a new rendezvous server for the given port, where 0 picks a free one.
+func NewServer(port int) *Server {
 	s := &Server{
 		portMap: make(map[string]string),
+		held:    make(map[string]*hold),
+		clients: make(map[string]*client),
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleRequest)
 	s.httpServer = &http.Server{
-		Addr:    ":" + RendezvousPort,
+		Addr:    ":" + strconv.Itoa(port),
 		Handler: mux,
 	}
 	return s
 }
 
-// handleRequest is the HTTP handler. It looks up the code and returns the port.
+// handleRequest is the HTTP handler. It looks up the code and returns the port,
+// unless the asking address has used up its lookups.
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Path[1:] // Trim leading "/"
-	s.mu.RLock()
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	s.mu.Lock()
+	c := s.client(ip, time.Now())
+	if !c.allow(time.Now()) {
+		s.mu.Unlock()
+		http.Error(w, "too many lookups", http.StatusTooManyRequests)
+		return
+	}
 	port, ok := s.portMap[code]
-	s.mu.RUnlock()
+	if ok {
+		delete(s.portMap, code)
+		h := &hold{port: port, ip: ip}
+		h.timer = time.AfterFunc(lookupGrace, func() { s.release(code, h) })
+		s.held[code] = h
+	} else {
+		c.miss(time.Now())
+	}
+	s.mu.Unlock()
 
 	if !ok {
 		http.NotFound(w, r)
@@ -43,12 +108,89 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, port)
 }
 
-// Start runs the HTTP server in a new goroutine.
-func (s *Server) Start() {
+// client returns the record for an address, creating it with a full bucket of
+// lookups. When too many addresses are tracked, those that have been quiet long
+// enough to have their bucket refilled and are not locked out are dropped first.
+// The caller must hold s.mu.
+func (s *Server) client(ip string, now time.Time) *client {
+	if c, ok := s.clients[ip]; ok {
+		return c
+	}
+	if len(s.clients) >= maxClients {
+		for addr, c := range s.clients {
+			if now.After(c.lockedUntil) && now.Sub(c.last) > lookupBurst*lookupInterval {
+				delete(s.clients, addr)
+			}
+		}
+	}
+	c := &client{tokens: lookupBurst, last: now}
+	s.clients[ip] = c
+	return c
+}
+
+// release makes a code resolvable again when no receiver connected after its lookup,
+// and charges the lookup to the address that made it.
+func (s *Server) release(code string, h *hold) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held[code] != h {
+		return
+	}
+	delete(s.held, code)
+	s.portMap[code] = h.port
+	if c, ok := s.clients[h.ip]; ok {
+		c.miss(time.Now())
+	}
+}
+
+// unhold forgets that a code was looked up. The caller must hold s.mu.
+func (s *Server) unhold(code string) {
+	if h, ok := s.held[code]; ok {
+		h.timer.Stop()
+		delete(s.held, code)
+	}
+}
+
+// miss counts a lookup that led nowhere, and locks the address out after too many.
+func (c *client) miss(now time.Time) {
+	if c.misses++; c.misses >= maxMisses {
+		c.lockedUntil = now.Add(lockoutDuration)
+		c.misses = 0
+	}
+}
+
+// allow reports whether the address may look up a code now, and takes a token if so.
+func (c *client) allow(now time.Time) bool {
+	if now.Before(c.lockedUntil) {
+		return false
+	}
+	c.tokens = min(lookupBurst, c.tokens+float64(now.Sub(c.last))/float64(lookupInterval))
+	c.last = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// Start binds the server's port and runs the HTTP server in a new goroutine.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("could not start rendezvous server: %w", err)
+	}
+	s.listener = listener
 	go func() {
 		// This will block until the server is closed. Errors are expected on shutdown.
-		_ = s.httpServer.ListenAndServe()
+		_ = s.httpServer.Serve(listener)
 	}()
+	return nil
+}
+
+// Port returns the port the server listens on. It is only known once Start has
+// succeeded.
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
 }
 
 // Stop gracefully shuts down the HTTP server.
@@ -56,9 +198,27 @@ func (s *Server) Stop() error {
 	return s.httpServer.Close()
 }
 
-// Register maps a code to a specific port.
+// Deregister removes the mapping for a code.
+func (s *Server) Deregister(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unhold(code)
+	delete(s.portMap, code)
+}
+
+// Register maps a code to a specific port. Since a lookup uses the code up, a sender
+// that waits for another connection registers it again.
 func (s *Server) Register(code, port string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.unhold(code)
 	s.portMap[code] = port
 }
+
+// Consume tells the server that a connection followed the lookup of a code, so the
+// code stays used up instead of being handed out again after the grace period.
+func (s *Server) Consume(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unhold(code)
+}
@@ -0,0 +1,67 @@
+package rendezvous
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// lookup asks the server for a code from the given address and returns the status.
+func lookup(s *Server, ip, code string) int {
+	req := httptest.NewRequest(http.MethodGet, "/"+code, nil)
+	req.RemoteAddr = ip + ":40000"
+	rec := httptest.NewRecorder()
+	s.handleRequest(rec, req)
+	return rec.Code
+}
+
+// TestLookupIsOneTime checks that a code is handed out once, and stays gone once the
+// sender reports a connection.
+func TestLookupIsOneTime(t *testing.T) {
+	s := NewServer(0)
+	s.Register("code", "4242")
+
+	if got := lookup(s, "10.0.0.1", "code"); got != http.StatusOK {
+		t.Fatalf("first lookup: got status %d, want %d", got, http.StatusOK)
+	}
+	if got := lookup(s, "10.0.0.2", "code"); got != http.StatusNotFound {
+		t.Fatalf("second lookup: got status %d, want %d", got, http.StatusNotFound)
+	}
+	s.Consume("code")
+	if _, ok := s.held["code"]; ok {
+		t.Fatal("consumed code is still held")
+	}
+	if got := lookup(s, "10.0.0.2", "code"); got != http.StatusNotFound {
+		t.Fatalf("lookup after consume: got status %d, want %d", got, http.StatusNotFound)
+	}
+
+	s.Register("code", "4242")
+	if got := lookup(s, "10.0.0.2", "code"); got != http.StatusOK {
+		t.Fatalf("lookup after renewal: got status %d, want %d", got, http.StatusOK)
+	}
+}
+
+// TestUnconsumedLookupIsReleased checks that a lookup nobody follows up on gives the
+// code back and counts against the address that made it.
+func TestUnconsumedLookupIsReleased(t *testing.T) {
+	s := NewServer(0)
+	for range maxMisses {
+		s.Register("code", "4242")
+		if got := lookup(s, "10.0.0.1", "code"); got != http.StatusOK {
+			t.Fatalf("lookup: got status %d, want %d", got, http.StatusOK)
+		}
+		h := s.held["code"]
+		h.timer.Stop()
+		s.release("code", h)
+
+		if got := lookup(s, "10.0.0.2", "code"); got != http.StatusOK {
+			t.Fatalf("lookup after release: got status %d, want %d", got, http.StatusOK)
+		}
+		s.Consume("code")
+	}
+
+	s.Register("code", "4242")
+	if got := lookup(s, "10.0.0.1", "code"); got != http.StatusTooManyRequests {
+		t.Fatalf("lookup after %d released lookups: got status %d, want %d", maxMisses, got, http.StatusTooManyRequests)
+	}
+}
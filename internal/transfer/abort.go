@@ -0,0 +1,41 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// abortTimeout bounds how long a cancelled session spends telling the peer.
+const abortTimeout = 2 * time.Second
+
+// errPeerAborted is returned when the peer cancelled the session. The transfer is
+// over for good, so nothing waits for it to be resumed.
+var errPeerAborted = errors.New("the other side cancelled the transfer")
+
+// interruptReads fails any read on conns that is blocked, or started, once ctx is
+// done. Writes are left alone, so a frame that is on its way still goes out whole
+// and can be followed by an abort frame. The returned function stops watching ctx.
+func interruptReads(ctx context.Context, conns ...net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		for _, c := range conns {
+			c.SetReadDeadline(time.Now())
+		}
+	})
+}
+
+// abortSession tells the peer that this side cancelled the session, then reads and
+// drops whatever the peer still sends until it hangs up: closing a connection with
+// unread data resets it, which could destroy the abort frame before the peer has read
+// it. Both steps give up after abortTimeout; a peer that is gone finds out on its own.
+func abortSession(conn net.Conn, sess *session) {
+	if !sess.peer.has(capAbort) {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(abortTimeout))
+	if writeSealed(NewFrameWriter(conn), sess.send, msgAbort, 0, struct{}{}) == nil {
+		io.Copy(io.Discard, conn)
+	}
+}
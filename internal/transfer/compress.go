@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionMode decides whether file data is compressed before it is encrypted.
+type CompressionMode string
+
+const (
+	CompressAuto CompressionMode = "auto" // Compress files that a sample shows to be compressible.
+	CompressZstd CompressionMode = "zstd" // Compress every file with zstd.
+	CompressNone CompressionMode = "none" // Send raw bytes.
+)
+
+// compressionZstd names zstd in the manifest.
+const compressionZstd = "zstd"
+
+// ParseCompressionMode validates a compression mode given on the command line.
+func ParseCompressionMode(s string) (CompressionMode, error) {
+	switch m := CompressionMode(strings.ToLower(s)); m {
+	case CompressAuto, CompressZstd, CompressNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown compression mode %q (use auto, zstd or none)", s)
+}
+
+// With compression on, every chunk's plaintext starts with one of these flags.
+// Chunks that don't shrink are sent raw, so compression never costs more than a byte.
+const (
+	chunkFlagSize = 1
+
+	chunkRaw  byte = 0
+	chunkZstd byte = 1
+)
+
+// compressionSample is how much of a file auto mode compresses to decide whether
+// the rest is worth compressing, and compressionGain the ratio it must reach.
+const (
+	compressionSample = 128 * 1024
+	compressionGain   = 0.9
+)
+
+// Encoders and decoders are safe for concurrent EncodeAll and DecodeAll calls, so a
+// single pair serves every worker. The decoder refuses to inflate a chunk past the
+// largest chunk size, which defuses decompression bombs.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxChunkSize))
+)
+
+// worthCompressing compresses a sample of a file from offset on, and reports whether
+// it shrank enough to be worth compressing the whole file.
+func worthCompressing(path string, offset int64) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	sample := make([]byte, compressionSample)
+	n, err := file.ReadAt(sample, offset)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	if n == 0 {
+		return false
+	}
+	compressed := zstdEncoder.EncodeAll(sample[:n], nil)
+	return float64(len(compressed)) < compressionGain*float64(n)
+}
+
+// compressChunk compresses the plaintext that follows the flag byte at chunk[0] in
+// place and sets the flag, using scratch as working space. A chunk that does not
+// shrink is left raw.
+func compressChunk(chunk, scratch []byte) []byte {
+	compressed := zstdEncoder.EncodeAll(chunk[1:], scratch[:0])
+	if len(compressed) >= len(chunk)-1 {
+		chunk[0] = chunkRaw
+		return chunk
+	}
+	chunk[0] = chunkZstd
+	return chunk[:1+copy(chunk[1:], compressed)]
+}
+
+// decompress undoes compressChunk on a decrypted chunk. A compressed chunk is inflated
+// into a fresh pooled buffer, which takes the place of the job's buffer. The result
+// never exceeds chunkSize bytes.
+func (j *chunkJob) decompress(chunkSize int) error {
+	if len(j.data) == 0 {
+		return fmt.Errorf("empty chunk")
+	}
+	switch j.data[0] {
+	case chunkRaw:
+		j.data = j.data[1:]
+		return nil
+	case chunkZstd:
+		out := getChunkBuffer(chunkSize)
+		plaintext, err := zstdDecoder.DecodeAll(j.data[1:], (*out)[:0])
+		if err != nil || len(plaintext) > chunkSize {
+			chunkPool.Put(out)
+			return fmt.Errorf("could not decompress chunk")
+		}
+		chunkPool.Put(j.buf)
+		j.buf, j.data = out, plaintext
+		return nil
+	}
+	return fmt.Errorf("unknown chunk encoding %d", j.data[0])
+}
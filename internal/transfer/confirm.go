@@ -2,32 +2,151 @@ package transfer
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// stdin is shared by every prompt, so buffered input meant for a later question is
+// not lost when an earlier one reads ahead.
+var stdin = bufio.NewReader(os.Stdin)
+
+// answer is a line read from stdin.
+type answer struct {
+	line string
+	err  error
+}
+
+// pendingAnswer holds the read started by a prompt that was cancelled before the user
+// replied. A read can't be called off, so the next prompt takes over its answer
+// instead of racing it for the input.
+var (
+	pendingMu     sync.Mutex
+	pendingAnswer chan answer
+)
+
+// readAnswer prints a question and returns the user's trimmed, lower-cased answer. It
+// gives up when ctx is done.
+func readAnswer(ctx context.Context, question string) (string, error) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	fmt.Fprint(os.Stderr, question)
+	if pendingAnswer == nil {
+		pendingAnswer = make(chan answer, 1)
+		go func(c chan<- answer) {
+			line, err := stdin.ReadString('\n')
+			c <- answer{line, err}
+		}(pendingAnswer)
+	}
+
+	var a answer
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return "", context.Cause(ctx)
+	case a = <-pendingAnswer:
+		pendingAnswer = nil
+	}
+	if a.err != nil && a.line == "" {
+		return "", a.err
+	}
+	return strings.TrimSpace(strings.ToLower(a.line)), nil
+}
+
 // promptForConfirmation displays the SAS and waits for the user to confirm.
-func promptForConfirmation(sas string) error {
-	fmt.Println("--------------------------------------------------")
-	fmt.Println("Please verify the following authentication string")
-	fmt.Println("with the other user:")
-	fmt.Printf("\n    ✅ %s ✅\n\n", sas)
-	fmt.Println("--------------------------------------------------")
-	fmt.Print("Do these strings match? (y/n): ")
-
-	reader := bufio.NewReader(os.Stdin)
-	input, err := reader.ReadString('\n')
+func promptForConfirmation(ctx context.Context, sas string) error {
+	fmt.Fprintln(os.Stderr, "--------------------------------------------------")
+	fmt.Fprintln(os.Stderr, "Please verify the following authentication string")
+	fmt.Fprintln(os.Stderr, "with the other user:")
+	fmt.Fprintf(os.Stderr, "\n    ✅ %s ✅\n\n", sas)
+	fmt.Fprintln(os.Stderr, "--------------------------------------------------")
+
+	input, err := readAnswer(ctx, "Do these strings match? (y/n): ")
 	if err != nil {
 		return fmt.Errorf("could not read confirmation: %w", err)
 	}
 
-	input = strings.TrimSpace(strings.ToLower(input))
-
 	if input != "y" && input != "yes" {
 		return fmt.Errorf("user aborted transfer")
 	}
 
-	fmt.Println("Confirmation received.")
+	fmt.Fprintln(os.Stderr, "Confirmation received.")
 	return nil
 }
+
+// promptForAcceptance asks the receiver whether to download the files in the manifest,
+// which must already have been listed with printSummary. It returns the manifest
+// indices the user left out, or declined if nothing should be downloaded at all.
+func promptForAcceptance(ctx context.Context, manifest transferManifest) (excluded map[int]bool, declined bool, err error) {
+	for {
+		input, err := readAnswer(ctx, "Accept these files? [y]es, [n]o or [s]elect: ")
+		if err != nil {
+			return nil, false, fmt.Errorf("could not read answer: %w", err)
+		}
+
+		switch input {
+		case "y", "yes":
+			return nil, false, nil
+		case "n", "no":
+			return nil, true, nil
+		case "s", "select":
+			input, err := readAnswer(ctx, "Files to download (e.g. 1,3-5): ")
+			if err != nil {
+				return nil, false, fmt.Errorf("could not read answer: %w", err)
+			}
+			selected, err := parseSelection(input, manifest)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+
+			excluded := make(map[int]bool)
+			for i, e := range manifest.Entries {
+				if !e.IsDir && !selected[i] {
+					excluded[i] = true
+				}
+			}
+			if len(selected) == 0 {
+				return nil, true, nil
+			}
+			return excluded, false, nil
+		}
+	}
+}
+
+// parseSelection turns a list of file numbers and ranges, as shown by printSummary,
+// into the set of manifest indices they refer to.
+func parseSelection(input string, manifest transferManifest) (map[int]bool, error) {
+	var files []int // Manifest index of every numbered file.
+	for i, e := range manifest.Entries {
+		if !e.IsDir {
+			files = append(files, i)
+		}
+	}
+
+	selected := make(map[int]bool)
+	for _, field := range strings.Split(input, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(field, "-")
+		lo, err := strconv.Atoi(strings.TrimSpace(first))
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.Atoi(strings.TrimSpace(last))
+		}
+		if err != nil || lo < 1 || hi > len(files) || lo > hi {
+			return nil, fmt.Errorf("invalid selection %q (choose between 1 and %d)", field, len(files))
+		}
+		for n := lo; n <= hi; n++ {
+			selected[files[n-1]] = true
+		}
+	}
+	return selected, nil
+}
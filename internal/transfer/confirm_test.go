@@ -0,0 +1,65 @@
+package transfer
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// TestParseSelection checks how file numbers and ranges map onto manifest indices.
+// Directories get no number, so the numbers skip over them.
+func TestParseSelection(t *testing.T) {
+	manifest := transferManifest{Entries: []fileMetadata{
+		{Name: "photos", IsDir: true},
+		{Name: "photos/a.jpg", Size: 1},
+		{Name: "photos/b.jpg", Size: 1},
+		{Name: "notes.txt", Size: 1},
+		{Name: "c.bin", Size: 1},
+	}}
+
+	tests := []struct {
+		input string
+		want  []int // Selected manifest indices; nil if the input must be refused.
+	}{
+		{"1", []int{1}},
+		{"4", []int{4}},
+		{"2-3", []int{2, 3}},
+		{"1-4", []int{1, 2, 3, 4}},
+		{"3-3", []int{3}},
+		{" 1 , 4 ", []int{1, 4}},
+		{"2 - 3", []int{2, 3}},
+		{"1,1,1-2,2", []int{1, 2}},
+		{"1-3,2-4", []int{1, 2, 3, 4}},
+		{"", []int{}},
+		{" , ,", []int{}},
+		{"0", nil},
+		{"5", nil},
+		{"3-5", nil},
+		{"0-2", nil},
+		{"4-2", nil},
+		{"-1", nil},
+		{"1-", nil},
+		{"1-2-3", nil},
+		{"one", nil},
+		{"1;2", nil},
+		{"1.5", nil},
+		{"1,x", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			selected, err := parseSelection(tt.input, manifest)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("parseSelection accepted it as %v", slices.Sorted(maps.Keys(selected)))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := slices.Sorted(maps.Keys(selected)); !slices.Equal(got, tt.want) {
+				t.Errorf("selected %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// attemptDelay is how long an attempt runs on its own before the next candidate is
+// tried alongside it, as recommended by Happy Eyeballs (RFC 8305).
+const attemptDelay = 250 * time.Millisecond
+
+// attemptTimeout bounds a single attempt, up to the end of the hello exchange. The
+// sender also gives the peer this long for every later step of the handshake.
+const attemptTimeout = 10 * time.Second
+
+// raceAttempts runs attempt for every candidate in turn. The next one starts as soon
+// as the previous fails or attemptDelay has passed, so a dead address costs little.
+// The first success wins and the other attempts are cancelled, as are all of them once
+// ctx is done; a success that comes in too late is handed to discard.
+func raceAttempts[T any](ctx context.Context, n int, attempt func(ctx context.Context, i int) (T, error), discard func(T)) (T, error) {
+	if n == 0 {
+		var zero T
+		return zero, fmt.Errorf("no address to connect to")
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	results := make(chan result, n)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var errs []error
+	started, running := 0, 0
+	for {
+		select {
+		case <-timer.C:
+			if started == n {
+				continue
+			}
+			i := started
+			go func() {
+				value, err := attempt(ctx, i)
+				results <- result{value, err}
+			}()
+			started++
+			running++
+			timer.Reset(attemptDelay)
+
+		case r := <-results:
+			running--
+			if r.err == nil {
+				go func() {
+					for range running {
+						if late := <-results; late.err == nil {
+							discard(late.value)
+						}
+					}
+				}()
+				return r.value, nil
+			}
+			errs = append(errs, r.err)
+			if started < n {
+				timer.Reset(0)
+			} else if running == 0 {
+				var zero T
+				if err := parent.Err(); err != nil {
+					return zero, err
+				}
+				return zero, mostRelevant(errs)
+			}
+		}
+	}
+}
+
+// mostRelevant picks the error to report once every attempt has failed. An address
+// where the sender answered says more than ones that could not be reached.
+func mostRelevant(errs []error) error {
+	for _, err := range errs {
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+// dialSender connects to every candidate address of the sender and keeps the first
+// connection that completes the hello exchange. The losing connections are closed,
+// which the sender shrugs off as connections that never said hello.
+func dialSender(ctx context.Context, addrs []string, p handshakeParams) (net.Conn, *helloResult, error) {
+	type dialed struct {
+		conn net.Conn
+		peer *helloResult
+	}
+
+	attempt := func(ctx context.Context, i int) (dialed, error) {
+		dialer := net.Dialer{Timeout: attemptTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addrs[i])
+		if err != nil {
+			return dialed{}, err
+		}
+
+		// An attempt that is still waiting for its hello when another one wins is cut off.
+		conn.SetDeadline(time.Now().Add(attemptTimeout))
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		peer, err := exchangeHello(conn, p.auth(), p.chunkSize)
+		if !stop() {
+			return dialed{}, ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return dialed{}, err
+		}
+		conn.SetDeadline(time.Time{})
+		return dialed{conn, peer}, nil
+	}
+
+	d, err := raceAttempts(ctx, len(addrs), attempt, func(d dialed) { d.conn.Close() })
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to sender: %w", err)
+	}
+	return d.conn, d.peer, nil
+}
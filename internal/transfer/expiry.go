@@ -0,0 +1,47 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrExpired is returned by Sender.Start when the code's TTL runs out before any
+// receiver has started a transfer.
+var ErrExpired = errors.New("the transfer code expired")
+
+// countdown shows how long the code has left while the sender waits for a connection,
+// rewriting one line of standard error every second. When standard error is not a
+// terminal the remaining time is printed once. The returned function stops it.
+func countdown(deadline time.Time) (stop func()) {
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Fprintf(os.Stderr, "⏳ Code expires in %s\n", time.Until(deadline).Round(time.Second))
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var line string
+		for {
+			remaining := max(time.Until(deadline).Round(time.Second), 0)
+			line = fmt.Sprintf("⏳ Code expires in %s ", remaining)
+			fmt.Fprintf(os.Stderr, "\r%s", line)
+			select {
+			case <-ticker.C:
+			case <-done:
+				fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", len(line)))
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,228 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// msgType identifies the kind of message carried in a frame.
+type msgType uint8
+
+const (
+	msgHello    msgType = iota + 1 // Protocol version and capabilities, sent in the clear.
+	msgManifest                    // Sender -> receiver list of entries.
+	msgRequest                     // Receiver -> sender transfer request.
+	msgResume                      // Sender -> receiver accepted resume point.
+	msgChunk                       // Sender -> receiver file data, counted by chunk index.
+	msgTrailer                     // Sender -> receiver end of a file, counted by manifest index.
+	msgStream                      // Sender -> receiver opening of an extra data connection.
+	msgAbort                       // Either way: the peer cancelled the session.
+	msgDone                        // Receiver -> sender every file arrived and was verified.
+)
+
+func (t msgType) String() string {
+	switch t {
+	case msgHello:
+		return "hello"
+	case msgManifest:
+		return "manifest"
+	case msgRequest:
+		return "request"
+	case msgResume:
+		return "resume"
+	case msgChunk:
+		return "chunk"
+	case msgTrailer:
+		return "trailer"
+	case msgStream:
+		return "stream"
+	case msgAbort:
+		return "abort"
+	case msgDone:
+		return "done"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// frameHeaderSize is the size of a frame header: a type byte and a payload length.
+const frameHeaderSize = 5
+
+// sealOverhead is the room a sealed payload needs on top of its plaintext.
+const sealOverhead = 16
+
+// maxFrameSizes bounds the payload of each message type, so a corrupt or hostile
+// header can't make us allocate gigabytes. Frames of any other type are rejected.
+var maxFrameSizes = map[msgType]int{
+	msgHello:    4 * 1024,
+	msgManifest: 16 * 1024 * 1024,
+	msgRequest:  16 * 1024 * 1024,
+	msgResume:   1024,
+	msgChunk:    MaxChunkSize + chunkFlagSize + sealOverhead,
+	msgTrailer:  1024,
+	msgStream:   1024,
+	msgAbort:    1024,
+	msgDone:     1024,
+}
+
+// FrameReader reads typed, length-prefixed frames. It reads no further than the
+// current frame, so the raw handshake messages can be read from the same connection.
+type FrameReader struct {
+	r      io.Reader
+	header [frameHeaderSize]byte
+	buf    []byte
+	limits map[msgType]int // Overrides of maxFrameSizes for this connection.
+	abort  cipher.AEAD     // Opens the peer's abort frame, once the session keys are known.
+}
+
+// NewFrameReader returns a FrameReader reading from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+// ReadFrame reads the next frame, which must have one of the wanted types. The header
+// is checked before any of the payload is read or room is made for it, so a peer can't
+// make us allocate for frames that have no business arriving yet. The payload is only
+// valid until the next call, as its buffer is reused.
+func (fr *FrameReader) ReadFrame(want ...msgType) (msgType, []byte, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return 0, nil, err
+	}
+	t := msgType(fr.header[0])
+	size := binary.LittleEndian.Uint32(fr.header[1:])
+
+	// An abort can arrive in place of anything, but only once it can be opened.
+	if !slices.Contains(want, t) && (t != msgAbort || fr.abort == nil) {
+		if len(want) == 1 {
+			return 0, nil, fmt.Errorf("expected %s message, got %s", want[0], t)
+		}
+		return 0, nil, fmt.Errorf("unexpected %s frame", t)
+	}
+	limit, ok := fr.limits[t]
+	if !ok {
+		limit, ok = maxFrameSizes[t]
+	}
+	if !ok {
+		return 0, nil, fmt.Errorf("unexpected %s frame", t)
+	}
+	if int64(size) > int64(limit) {
+		return 0, nil, fmt.Errorf("%s frame of %d bytes exceeds the limit of %d", t, size, limit)
+	}
+
+	if cap(fr.buf) < int(size) {
+		fr.buf = make([]byte, size)
+	}
+	payload := fr.buf[:size]
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		return 0, nil, err
+	}
+	if t == msgAbort {
+		return 0, nil, fr.openAbort(payload)
+	}
+	return t, payload, nil
+}
+
+// WatchAbort makes the reader recognise the peer's abort frame, sealed with aead.
+// Whatever the reader was waiting for, an authentic abort fails the read with
+// errPeerAborted. Before that, abort frames are rejected.
+func (fr *FrameReader) WatchAbort(aead cipher.AEAD) {
+	fr.abort = aead
+}
+
+// openAbort authenticates an abort frame, so nobody but the peer can end the session.
+func (fr *FrameReader) openAbort(sealed []byte) error {
+	if fr.abort == nil {
+		return fmt.Errorf("unexpected %s frame", msgAbort)
+	}
+	if err := openSealed(fr.abort, msgAbort, 0, sealed, &struct{}{}); err != nil {
+		return err
+	}
+	return errPeerAborted
+}
+
+// SetLimit lowers the maximum payload accepted for one message type, for example to
+// the chunk size negotiated for the session.
+func (fr *FrameReader) SetLimit(t msgType, size int) {
+	if fr.limits == nil {
+		fr.limits = make(map[msgType]int)
+	}
+	fr.limits[t] = size
+}
+
+// Expect reads the next frame, which must have the wanted type.
+func (fr *FrameReader) Expect(want msgType) ([]byte, error) {
+	_, payload, err := fr.ReadFrame(want)
+	return payload, err
+}
+
+// FrameWriter writes typed, length-prefixed frames, each with a single write.
+type FrameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewFrameWriter returns a FrameWriter writing to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame sends one frame: a type byte, the payload length and the payload.
+func (fw *FrameWriter) WriteFrame(t msgType, payload []byte) error {
+	limit, ok := maxFrameSizes[t]
+	if !ok {
+		return fmt.Errorf("unknown message type %d", uint8(t))
+	}
+	if len(payload) > limit {
+		return fmt.Errorf("%s message of %d bytes exceeds the limit of %d", t, len(payload), limit)
+	}
+
+	fw.buf = append(fw.buf[:0], byte(t), 0, 0, 0, 0)
+	fw.buf = append(fw.buf, payload...)
+	return fw.flush()
+}
+
+// WriteSealed seals plaintext straight into the frame buffer and sends it, so no
+// ciphertext buffer is allocated per message.
+func (fw *FrameWriter) WriteSealed(t msgType, aead cipher.AEAD, nonce, plaintext []byte) error {
+	frame, err := appendSealedFrame(fw.buf[:0], t, aead, nonce, plaintext)
+	if err != nil {
+		return err
+	}
+	fw.buf = frame
+	_, err = fw.w.Write(frame)
+	return err
+}
+
+// WriteRaw sends a frame that was already built by appendSealedFrame.
+func (fw *FrameWriter) WriteRaw(frame []byte) error {
+	_, err := fw.w.Write(frame)
+	return err
+}
+
+// appendSealedFrame appends a complete frame holding the sealed plaintext to dst. The
+// plaintext may sit right after the frame header in dst's backing array, in which case
+// it is sealed in place.
+func appendSealedFrame(dst []byte, t msgType, aead cipher.AEAD, nonce, plaintext []byte) ([]byte, error) {
+	limit, ok := maxFrameSizes[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %d", uint8(t))
+	}
+	size := len(plaintext) + aead.Overhead()
+	if size > limit {
+		return nil, fmt.Errorf("%s message of %d bytes exceeds the limit of %d", t, size, limit)
+	}
+
+	start := len(dst)
+	dst = append(dst, byte(t), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(dst[start+1:], uint32(size))
+	return aead.Seal(dst, nonce, plaintext, nil), nil
+}
+
+// flush fills in the payload length of the frame in the buffer and writes it.
+func (fw *FrameWriter) flush() error {
+	binary.LittleEndian.PutUint32(fw.buf[1:], uint32(len(fw.buf)-frameHeaderSize))
+	_, err := fw.w.Write(fw.buf)
+	return err
+}
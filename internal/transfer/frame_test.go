@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// frameHeader builds a header announcing size bytes of type t.
+func frameHeader(t msgType, size uint32) []byte {
+	h := make([]byte, frameHeaderSize)
+	h[0] = byte(t)
+	binary.LittleEndian.PutUint32(h[1:], size)
+	return h
+}
+
+// TestReadFrameRejectsHeaders checks that frames of the wrong type or size are refused
+// on their header alone: nothing past it is read and no room is made for the payload.
+func TestReadFrameRejectsHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   []msgType
+		err    string
+	}{
+		{"manifest instead of hello", frameHeader(msgManifest, 16*1024*1024), []msgType{msgHello}, "expected hello message, got manifest"},
+		{"chunk instead of hello", frameHeader(msgChunk, MaxChunkSize), []msgType{msgHello}, "expected hello message, got chunk"},
+		{"request on a stream port", frameHeader(msgRequest, 16*1024*1024), []msgType{msgStream}, "expected stream message, got request"},
+		{"oversized hello", frameHeader(msgHello, 4*1024+1), []msgType{msgHello}, "exceeds the limit"},
+		{"oversized stream opening", frameHeader(msgStream, 1<<31), []msgType{msgStream}, "exceeds the limit"},
+		{"oversized chunk", frameHeader(msgChunk, uint32(maxFrameSizes[msgChunk])+1), []msgType{msgChunk, msgTrailer}, "exceeds the limit"},
+		{"unknown type", frameHeader(0x7f, 10), []msgType{msgChunk, msgTrailer}, "unexpected unknown(127) frame"},
+		{"abort before keys", frameHeader(msgAbort, 100), []msgType{msgHello}, "expected hello message, got abort"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The body is never there: reading it would fail with EOF instead.
+			in := &countingReader{r: bytes.NewReader(tt.header)}
+			fr := NewFrameReader(in)
+			_, _, err := fr.ReadFrame(tt.want...)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("ReadFrame = %v, want an error containing %q", err, tt.err)
+			}
+			if in.n != frameHeaderSize {
+				t.Errorf("read %d bytes, want only the %d of the header", in.n, frameHeaderSize)
+			}
+			if cap(fr.buf) != 0 {
+				t.Errorf("allocated %d bytes for a rejected frame", cap(fr.buf))
+			}
+		})
+	}
+}
+
+// TestReadFrameLimit checks that a lowered limit applies to the header as well.
+func TestReadFrameLimit(t *testing.T) {
+	in := &countingReader{r: bytes.NewReader(frameHeader(msgChunk, 64*1024+chunkFlagSize+sealOverhead+1))}
+	fr := NewFrameReader(in)
+	fr.SetLimit(msgChunk, 64*1024+chunkFlagSize+sealOverhead)
+	if _, err := fr.Expect(msgChunk); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("Expect = %v, want a size error", err)
+	}
+	if in.n != frameHeaderSize || cap(fr.buf) != 0 {
+		t.Errorf("read %d bytes and allocated %d for a rejected frame", in.n, cap(fr.buf))
+	}
+}
+
+// TestReadFrameAccepts checks that wanted frames come through intact, in sequence.
+func TestReadFrameAccepts(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewFrameWriter(&buf)
+	for _, f := range []struct {
+		t       msgType
+		payload string
+	}{{msgChunk, "data"}, {msgTrailer, "end"}, {msgHello, "{}"}} {
+		if err := w.WriteFrame(f.t, []byte(f.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fr := NewFrameReader(&buf)
+	for _, want := range []struct {
+		t       msgType
+		payload string
+	}{{msgChunk, "data"}, {msgTrailer, "end"}} {
+		got, payload, err := fr.ReadFrame(msgChunk, msgTrailer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want.t || string(payload) != want.payload {
+			t.Errorf("ReadFrame = %s %q, want %s %q", got, payload, want.t, want.payload)
+		}
+	}
+	if payload, err := fr.Expect(msgHello); err != nil || string(payload) != "{}" {
+		t.Errorf("Expect(hello) = %q, %v", payload, err)
+	}
+}
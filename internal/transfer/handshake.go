@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sumanthd032/lancrypt/pkg/crypto"
+)
+
+// handshakeLabel names the protocol and version in the handshake transcript.
+const handshakeLabel = "LanCrypt handshake v1"
+
+// handshakeParams describes one side of a handshake. The receiver initiates, the
+// sender responds.
+type handshakeParams struct {
+	initiator    bool
+	code         string // Public part of the transfer code.
+	passphrase   string
+	argon2       crypto.Argon2Params // Minimum cost for stretching the passphrase.
+	argon2Limit  crypto.Argon2Params // Highest cost the peer may ask for.
+	pakePassword string              // Full code including the secret suffix; empty for a plain exchange.
+	chunkSize    int                 // Proposed chunk size.
+	timeout      time.Duration       // Bounds every wait for the peer until keys are confirmed; 0 waits forever.
+}
+
+// session holds the ciphers negotiated for one connection.
+type session struct {
+	send cipher.AEAD // Seals messages to the peer.
+	recv cipher.AEAD // Opens messages from the peer.
+	sas  string
+	peer *helloResult // Protocol version and capabilities agreed with the peer.
+}
+
+// auth returns the authentication mode announced in the hello.
+func (p handshakeParams) auth() string {
+	if p.pakePassword != "" {
+		return authPAKE
+	}
+	return authSAS
+}
+
+// performHandshake runs the key exchange after the hellos have been swapped, derives
+// directional session keys bound to the transcript, and confirms that both peers hold
+// the same keys.
+func performHandshake(conn net.Conn, p handshakeParams, peer *helloResult) (*session, error) {
+	mode := "x25519"
+	if p.pakePassword != "" {
+		mode = "cpace"
+	}
+
+	// Both hellos go into the transcript, so a downgrade of the version or the
+	// capabilities by an attacker breaks key confirmation.
+	transcript := crypto.NewTranscript(handshakeLabel)
+	transcript.Append([]byte(mode), []byte(p.code))
+	if p.initiator {
+		transcript.Append(peer.local, peer.remote)
+	} else {
+		transcript.Append(peer.remote, peer.local)
+	}
+
+	p.armDeadline(conn)
+	argon2, err := negotiateArgon2(conn, p.argon2, p.argon2Limit, transcript, p.initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	var initialSecret *[crypto.KeySize]byte
+	if p.pakePassword != "" {
+		initialSecret, err = crypto.PerformPAKE(conn, []byte(p.pakePassword), transcript, p.initiator)
+		if err != nil {
+			return nil, fmt.Errorf("password-authenticated key exchange failed: %w", err)
+		}
+	} else {
+		privateKey, publicKey, err := crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		initialSecret, err = crypto.PerformKeyExchange(conn, privateKey, publicKey, transcript, p.initiator)
+		if err != nil {
+			return nil, fmt.Errorf("key exchange failed: %w", err)
+		}
+	}
+
+	// The transcript hash is unique to this session, which makes it a good salt.
+	transcriptHash := transcript.Sum()
+	var passphraseKey []byte
+	if p.passphrase != "" {
+		fmt.Fprintf(os.Stderr, "🔑 Stretching passphrase with Argon2id (%s)...\n", argon2)
+		passphraseKey = crypto.StretchPassphrase(p.passphrase, transcriptHash, argon2)
+	}
+
+	keys, err := crypto.DeriveSessionKeys(initialSecret, passphraseKey, transcriptHash)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	// Stretching may take a while, which is no fault of the peer's.
+	p.armDeadline(conn)
+	if err := crypto.ConfirmKeys(conn, keys, transcriptHash, p.initiator); err != nil {
+		if errors.Is(err, crypto.ErrKeyMismatch) {
+			return nil, fmt.Errorf("handshake failed: %w", err)
+		}
+		return nil, fmt.Errorf("key confirmation failed: %w", err)
+	}
+
+	sendKey, recvKey := &keys.SenderToReceiver, &keys.ReceiverToSender
+	if p.initiator {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	s := &session{sas: crypto.GenerateSAS(&keys.SAS, 3), peer: peer}
+	if s.send, err = crypto.NewAESGCM(sendKey); err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+	if s.recv, err = crypto.NewAESGCM(recvKey); err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+	return s, nil
+}
+
+// armDeadline gives the peer p.timeout to answer the next step of the handshake.
+func (p handshakeParams) armDeadline(conn net.Conn) {
+	if p.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.timeout))
+	}
+}
+
+// negotiateArgon2 swaps Argon2id parameters with the peer and settles on the stronger
+// of each. Parameters beyond the sane bounds or the local limit are refused rather
+// than obeyed: the peer is not authenticated yet, so it must not be able to make us
+// burn memory and time. Both sets go into the transcript, so tampering with them
+// breaks key confirmation.
+func negotiateArgon2(conn net.Conn, local, limit crypto.Argon2Params, transcript *crypto.Transcript, initiator bool) (crypto.Argon2Params, error) {
+	localBytes, _ := local.MarshalBinary()
+	if _, err := conn.Write(localBytes); err != nil {
+		return crypto.Argon2Params{}, fmt.Errorf("failed to send argon2 parameters: %w", err)
+	}
+	remoteBytes := make([]byte, crypto.Argon2ParamsSize)
+	if _, err := io.ReadFull(conn, remoteBytes); err != nil {
+		return crypto.Argon2Params{}, fmt.Errorf("failed to receive argon2 parameters: %w", err)
+	}
+
+	var remote crypto.Argon2Params
+	if err := remote.UnmarshalBinary(remoteBytes); err != nil {
+		return crypto.Argon2Params{}, err
+	}
+	if err := remote.Validate(); err != nil {
+		return crypto.Argon2Params{}, fmt.Errorf("peer asked for unacceptable parameters: %w", err)
+	}
+	// Whatever we ask for ourselves is clearly affordable.
+	if err := remote.Within(limit.Max(local)); err != nil {
+		return crypto.Argon2Params{}, fmt.Errorf("peer asked for unacceptable parameters: %w", err)
+	}
+
+	if initiator {
+		transcript.Append(localBytes, remoteBytes)
+	} else {
+		transcript.Append(remoteBytes, localBytes)
+	}
+	return local.Max(remote), nil
+}
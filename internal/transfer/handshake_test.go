@@ -0,0 +1,117 @@
+package transfer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sumanthd032/lancrypt/pkg/crypto"
+)
+
+// cheapArgon2 keeps passphrase stretching in tests as fast as Validate allows.
+var cheapArgon2 = crypto.Argon2Params{Time: 1, MemoryKiB: 8 * 1024, Threads: 1}
+
+// handshakeResult is what one side of handshakePair ends up with.
+type handshakeResult struct {
+	sess *session
+	err  error
+}
+
+// handshakePair runs the hellos and the handshake between a sender and a receiver over
+// loopback TCP, which buffers the messages both sides write before reading.
+func handshakePair(t *testing.T, sender, receiver handshakeParams) (sent, received handshakeResult) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	run := func(conn net.Conn, p handshakeParams) handshakeResult {
+		peer, err := exchangeHello(conn, p.auth(), p.chunkSize)
+		if err != nil {
+			return handshakeResult{err: err}
+		}
+		sess, err := performHandshake(conn, p, peer)
+		return handshakeResult{sess, err}
+	}
+	senderDone := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			senderDone <- handshakeResult{err: err}
+			return
+		}
+		defer conn.Close()
+		senderDone <- run(conn, sender)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receiver.initiator = true
+	received = run(conn, receiver)
+	// A failed side hangs up, which ends the other one's wait.
+	conn.Close()
+	return <-senderDone, received
+}
+
+// TestHandshakePassphrase checks that peers only agree on keys when they hold the same
+// passphrase, and that agreeing peers see the same SAS and each other's send key.
+func TestHandshakePassphrase(t *testing.T) {
+	tests := []struct {
+		name             string
+		sender, receiver string
+		wantKeyMismatch  bool
+	}{
+		{"same passphrase", "correct horse", "correct horse", false},
+		{"no passphrase", "", "", false},
+		{"different passphrases", "correct horse", "battery staple", true},
+		{"passphrase on the sender only", "correct horse", "", true},
+		{"passphrase on the receiver only", "", "correct horse", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			silenceOutput(t)
+			params := func(passphrase string) handshakeParams {
+				return handshakeParams{code: "maple-otter", passphrase: passphrase, argon2: cheapArgon2, argon2Limit: cheapArgon2, chunkSize: DefaultChunkSize}
+			}
+			sent, received := handshakePair(t, params(tt.sender), params(tt.receiver))
+
+			if tt.wantKeyMismatch {
+				// The first side to find the mismatch hangs up, so only one of them
+				// may get to compare the keys.
+				if !errors.Is(sent.err, crypto.ErrKeyMismatch) && !errors.Is(received.err, crypto.ErrKeyMismatch) {
+					t.Fatalf("handshake errors = %v and %v, want %v", sent.err, received.err, crypto.ErrKeyMismatch)
+				}
+				if sent.err == nil || received.err == nil {
+					t.Fatalf("handshake errors = %v and %v, want both sides to fail", sent.err, received.err)
+				}
+				return
+			}
+
+			if sent.err != nil || received.err != nil {
+				t.Fatalf("handshake errors = %v and %v", sent.err, received.err)
+			}
+			if sent.sess.sas == "" || sent.sess.sas != received.sess.sas {
+				t.Errorf("SAS = %q and %q, want the same", sent.sess.sas, received.sess.sas)
+			}
+			nonce := make([]byte, sent.sess.send.NonceSize())
+			for _, dir := range []struct {
+				name     string
+				from, to *session
+			}{{"sender to receiver", sent.sess, received.sess}, {"receiver to sender", received.sess, sent.sess}} {
+				sealed := dir.from.send.Seal(nil, nonce, []byte("hello"), nil)
+				if opened, err := dir.to.recv.Open(nil, nonce, sealed, nil); err != nil || string(opened) != "hello" {
+					t.Errorf("%s: the peer could not open a sealed message: %v", dir.name, err)
+				}
+				// Each direction has its own key, so a message can't be reflected back.
+				if _, err := dir.from.recv.Open(nil, nonce, sealed, nil); err == nil {
+					t.Errorf("%s: the send and receive keys are the same", dir.name)
+				}
+			}
+		})
+	}
+}
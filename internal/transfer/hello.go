@@ -0,0 +1,128 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+)
+
+// Protocol versions this build can speak. Peers settle on the highest version both
+// support, and refuse to talk if their ranges don't overlap.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// protocolMagic opens every connection, so anything that is not a LanCrypt peer is
+// rejected before we try to interpret its bytes.
+var protocolMagic = []byte("LNCR")
+
+// Capabilities a peer can advertise in its hello.
+const (
+	capMultiFile   = "multi-file"   // Manifests with more than one entry.
+	capResume      = "resume"       // Resume points in the transfer request.
+	capPadding     = "padding"      // Padded file streams.
+	capAESGCM      = "aes-256-gcm"  // AES-256-GCM as the session cipher.
+	capMultiStream = "multi-stream" // Chunks spread over extra data connections.
+	capZstd        = "zstd"         // Chunks compressed with zstd.
+	capAbort       = "abort"        // Abort frames when a peer cancels the session.
+	capDone        = "done"         // The receiver confirms a completed transfer.
+)
+
+// localCapabilities lists everything this build supports.
+var localCapabilities = []string{capMultiFile, capResume, capPadding, capAESGCM, capMultiStream, capZstd, capAbort, capDone}
+
+// Authentication modes a peer can ask for.
+const (
+	authSAS  = "sas"  // Unauthenticated exchange, checked by comparing the SAS.
+	authPAKE = "pake" // Password-authenticated exchange keyed on the full code.
+)
+
+// hello is the first message on every connection.
+type hello struct {
+	Version      int      `json:"version"`     // Highest protocol version spoken.
+	MinVersion   int      `json:"min_version"` // Lowest protocol version spoken.
+	Capabilities []string `json:"capabilities"`
+	Auth         string   `json:"auth"`
+	ChunkSize    int      `json:"chunk_size"` // Largest chunk the peer wants to handle.
+}
+
+// helloResult is what the two hellos agreed on.
+type helloResult struct {
+	version      int
+	capabilities []string // Capabilities both peers support.
+	chunkSize    int      // Smaller of the two proposed chunk sizes.
+	local        []byte   // Our hello as sent, for the handshake transcript.
+	remote       []byte   // The peer's hello as received.
+}
+
+// has reports whether both peers support a capability.
+func (h *helloResult) has(capability string) bool {
+	return slices.Contains(h.capabilities, capability)
+}
+
+// exchangeHello sends our hello, reads the peer's and negotiates the protocol version,
+// shared capabilities and chunk size.
+func exchangeHello(conn net.Conn, auth string, chunkSize int) (*helloResult, error) {
+	local, _ := json.Marshal(hello{
+		Version:      protocolVersion,
+		MinVersion:   minProtocolVersion,
+		Capabilities: localCapabilities,
+		Auth:         auth,
+		ChunkSize:    chunkSize,
+	})
+	if _, err := conn.Write(protocolMagic); err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+	if err := NewFrameWriter(conn).WriteFrame(msgHello, local); err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	magic := make([]byte, len(protocolMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return nil, fmt.Errorf("failed to receive hello: %w", err)
+	}
+	if !bytes.Equal(magic, protocolMagic) {
+		return nil, fmt.Errorf("peer is not speaking the LanCrypt protocol (it may be an older, unversioned release)")
+	}
+	remote, err := NewFrameReader(conn).Expect(msgHello)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive hello: %w", err)
+	}
+	remote = bytes.Clone(remote)
+
+	var peer hello
+	if err := json.Unmarshal(remote, &peer); err != nil {
+		return nil, fmt.Errorf("could not decode hello: %w", err)
+	}
+
+	version := min(protocolVersion, peer.Version)
+	if version < minProtocolVersion || version < peer.MinVersion {
+		return nil, fmt.Errorf("incompatible protocol versions: we speak %d-%d, peer speaks %d-%d",
+			minProtocolVersion, protocolVersion, peer.MinVersion, peer.Version)
+	}
+	if peer.Auth != auth {
+		if auth == authSAS {
+			return nil, fmt.Errorf("the sender requires PAKE: use the full code including its numeric suffix")
+		}
+		return nil, fmt.Errorf("the peer is not using PAKE: check that the full code was entered on both sides")
+	}
+
+	if err := CheckChunkSize(peer.ChunkSize); err != nil {
+		return nil, fmt.Errorf("peer proposed an unacceptable chunk size: %w", err)
+	}
+
+	result := &helloResult{version: version, chunkSize: min(chunkSize, peer.ChunkSize), local: local, remote: remote}
+	for _, c := range peer.Capabilities {
+		if slices.Contains(localCapabilities, c) {
+			result.capabilities = append(result.capabilities, c)
+		}
+	}
+	if !result.has(capAESGCM) {
+		return nil, fmt.Errorf("no cipher in common with the peer")
+	}
+	return result, nil
+}
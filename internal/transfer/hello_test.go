@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// helloFrom runs exchangeHello over loopback TCP against a peer that sends raw and
+// then only listens.
+func helloFrom(t *testing.T, raw []byte, auth string, chunkSize int) (*helloResult, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(raw)
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return exchangeHello(conn, auth, chunkSize)
+}
+
+// rawHello encodes h the way a peer opens a connection.
+func rawHello(t *testing.T, magic []byte, h hello) []byte {
+	t.Helper()
+	payload, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(magic)
+	if err := NewFrameWriter(&buf).WriteFrame(msgHello, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestExchangeHelloRefuses checks that peers we can't or mustn't talk to are turned
+// away with an error that says why.
+func TestExchangeHelloRefuses(t *testing.T) {
+	peer := hello{Version: protocolVersion, MinVersion: minProtocolVersion, Capabilities: localCapabilities, Auth: authSAS, ChunkSize: DefaultChunkSize}
+	with := func(change func(*hello)) hello {
+		h := peer
+		change(&h)
+		return h
+	}
+
+	tests := []struct {
+		name  string
+		magic []byte
+		peer  hello
+		auth  string
+		err   string
+	}{
+		{"newer versions only", protocolMagic, with(func(h *hello) { h.MinVersion, h.Version = protocolVersion+1, protocolVersion+3 }), authSAS, "incompatible protocol versions"},
+		{"older versions only", protocolMagic, with(func(h *hello) { h.MinVersion, h.Version = minProtocolVersion-1, minProtocolVersion-1 }), authSAS, "incompatible protocol versions"},
+		{"wrong magic", []byte("HTTP"), peer, authSAS, "not speaking the LanCrypt protocol"},
+		{"sender wants PAKE", protocolMagic, with(func(h *hello) { h.Auth = authPAKE }), authSAS, "the sender requires PAKE"},
+		{"peer without PAKE", protocolMagic, peer, authPAKE, "the peer is not using PAKE"},
+		{"chunk size too small", protocolMagic, with(func(h *hello) { h.ChunkSize = MinChunkSize - 1 }), authSAS, "unacceptable chunk size"},
+		{"chunk size too large", protocolMagic, with(func(h *hello) { h.ChunkSize = MaxChunkSize + 1 }), authSAS, "unacceptable chunk size"},
+		{"no chunk size", protocolMagic, with(func(h *hello) { h.ChunkSize = 0 }), authSAS, "unacceptable chunk size"},
+		{"no cipher in common", protocolMagic, with(func(h *hello) { h.Capabilities = []string{capMultiFile, "chacha20-poly1305"} }), authSAS, "no cipher in common"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := helloFrom(t, rawHello(t, tt.magic, tt.peer), tt.auth, DefaultChunkSize)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("exchangeHello = %+v, %v, want an error containing %q", result, err, tt.err)
+			}
+		})
+	}
+}
+
+// TestExchangeHelloNegotiates checks what two compatible hellos settle on.
+func TestExchangeHelloNegotiates(t *testing.T) {
+	peer := hello{
+		Version:      protocolVersion + 2,
+		MinVersion:   minProtocolVersion,
+		Capabilities: []string{capAESGCM, capResume, "teleport"},
+		Auth:         authPAKE,
+		ChunkSize:    MinChunkSize,
+	}
+	result, err := helloFrom(t, rawHello(t, protocolMagic, peer), authPAKE, DefaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.version != protocolVersion {
+		t.Errorf("version = %d, want %d", result.version, protocolVersion)
+	}
+	if want := []string{capAESGCM, capResume}; !slices.Equal(result.capabilities, want) {
+		t.Errorf("capabilities = %q, want %q", result.capabilities, want)
+	}
+	if result.chunkSize != MinChunkSize {
+		t.Errorf("chunk size = %d, want the smaller proposal of %d", result.chunkSize, MinChunkSize)
+	}
+}
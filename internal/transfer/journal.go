@@ -0,0 +1,117 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// journalInterval is how many bytes are written between journal checkpoints. It is
+// counted in bytes rather than chunks, since the chunk size varies between sessions.
+const journalInterval = 16 * 1024 * 1024
+
+// resumeJournal records how far an interrupted transfer got, so that a reconnect
+// with the same code can continue from the last authenticated chunk. It holds a digest
+// of the manifest rather than the manifest itself, so saving it stays cheap however
+// many entries the transfer has.
+type resumeJournal struct {
+	Code     string `json:"code"`
+	Manifest []byte `json:"manifest"` // SHA-256 of the manifest being received.
+	File     int    `json:"file"`     // Index of the manifest entry in progress.
+	Offset   int64  `json:"offset"`   // Verified bytes of that entry already on disk.
+	Chunk    uint64 `json:"chunk"`    // Index of the next chunk to be received.
+	Hash     []byte `json:"hash"`     // Marshalled SHA-256 state over the verified bytes.
+
+	path string
+}
+
+// manifestDigest identifies a manifest, so a journal is only used for the same files.
+func manifestDigest(manifest transferManifest) []byte {
+	data, _ := json.Marshal(manifest)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// journalPath returns where the journal for a transfer code is kept.
+func journalPath(outDir, code string) string {
+	return filepath.Join(outDir, fmt.Sprintf(".lancrypt-%s.resume", code))
+}
+
+// loadJournal reads the journal for a code. It returns nil if there is nothing to
+// resume or the journal belongs to a different set of files.
+func loadJournal(outDir, code string, manifest transferManifest) *resumeJournal {
+	data, err := os.ReadFile(journalPath(outDir, code))
+	if err != nil {
+		return nil
+	}
+
+	var j resumeJournal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil
+	}
+	if j.Code != code || !bytes.Equal(j.Manifest, manifestDigest(manifest)) {
+		return nil
+	}
+	if j.File < 0 || j.File >= len(manifest.Entries) || j.Offset < 0 {
+		return nil
+	}
+	j.path = journalPath(outDir, code)
+	return &j
+}
+
+// newJournal starts an empty journal for a fresh transfer.
+func newJournal(outDir, code string, manifest transferManifest) *resumeJournal {
+	return &resumeJournal{Code: code, Manifest: manifestDigest(manifest), path: journalPath(outDir, code)}
+}
+
+// restoreHash rebuilds the running hash of the verified bytes of the current entry.
+func (j *resumeJournal) restoreHash() (hash.Hash, error) {
+	h := sha256.New()
+	if len(j.Hash) == 0 {
+		return h, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(j.Hash); err != nil {
+		return nil, fmt.Errorf("could not restore hash state: %w", err)
+	}
+	return h, nil
+}
+
+// checkpoint records the progress of the current entry and writes the journal to disk.
+// Callers must make sure the bytes it describes have been flushed to the output file.
+func (j *resumeJournal) checkpoint(offset int64, chunk uint64, h hash.Hash) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not save hash state: %w", err)
+	}
+	j.Offset, j.Chunk, j.Hash = offset, chunk, state
+	return j.save()
+}
+
+// advance moves the journal on to the next manifest entry. It is only written to disk
+// by the next save or checkpoint.
+func (j *resumeJournal) advance(chunk uint64) {
+	j.File, j.Offset, j.Chunk, j.Hash = j.File+1, 0, chunk, nil
+}
+
+// save writes the journal atomically, so a crash never leaves a torn journal behind.
+func (j *resumeJournal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("could not write resume journal: %w", err)
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// remove deletes the journal once the transfer has completed.
+func (j *resumeJournal) remove() {
+	os.Remove(j.path)
+}
@@ -0,0 +1,281 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/sumanthd032/lancrypt/pkg/util"
+)
+
+// fileMetadata holds information about a single entry being transferred.
+// Name is a slash-separated path relative to the receiver's output directory.
+type fileMetadata struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	IsDir  bool   `json:"dir,omitempty"`
+	Stream bool   `json:"stream,omitempty"` // Read from a pipe, so the size is only known at the end.
+	Text   bool   `json:"text,omitempty"`   // A text snippet, shown rather than saved by default.
+}
+
+// progressSize returns the total for an entry's progress bar, where -1 shows a plain
+// byte counter for streams of unknown size.
+func (m fileMetadata) progressSize() int64 {
+	if m.Stream {
+		return -1
+	}
+	return m.Size
+}
+
+// transferManifest lists every entry sent over a session, in the order they are streamed.
+type transferManifest struct {
+	Entries []fileMetadata `json:"entries"`
+	Padded  bool           `json:"padded,omitempty"` // File streams carry padding past their real size.
+
+	Compression string `json:"compression,omitempty"` // How chunks are compressed, if at all.
+}
+
+// totals returns the number of files and the combined size of their content.
+func (m *transferManifest) totals() (count int, size int64) {
+	for _, e := range m.Entries {
+		if !e.IsDir {
+			count++
+			size += e.Size
+		}
+	}
+	return count, size
+}
+
+// printSummary lists every incoming file, numbered for selection, and the total size
+// of the transfer.
+func (m *transferManifest) printSummary() {
+	count, size := m.totals()
+	total := util.FormatBytes(size) + " total"
+	if m.streamed() {
+		total = "size unknown"
+	}
+	fmt.Fprintf(os.Stderr, "📦 Incoming transfer: %d file(s), %s\n", count, total)
+	n := 0
+	for _, e := range m.Entries {
+		if e.IsDir {
+			continue
+		}
+		n++
+		size := util.FormatBytes(e.Size)
+		if e.Stream {
+			size = "stream"
+		} else if e.Text {
+			size = "text, " + size
+		}
+		fmt.Fprintf(os.Stderr, "    %3d. %s (%s)\n", n, e.Name, size)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// streamed reports whether any entry is a stream of unknown size.
+func (m *transferManifest) streamed() bool {
+	for _, e := range m.Entries {
+		if e.Stream {
+			return true
+		}
+	}
+	return false
+}
+
+// isText reports whether the transfer is a single text snippet.
+func (m *transferManifest) isText() bool {
+	return len(m.Entries) == 1 && m.Entries[0].Text
+}
+
+// validate checks every entry before any of them is shown or used, so a hostile
+// sender can neither escape the output directory nor drive the terminal with escape
+// sequences hidden in a name. Text is held in memory, so its size must be announced.
+func (m *transferManifest) validate() error {
+	for _, e := range m.Entries {
+		if _, err := sanitizeName(e.Name); err != nil {
+			return err
+		}
+		if e.Text && e.Stream {
+			return fmt.Errorf("refusing text of unknown size from peer: %q", e.Name)
+		}
+	}
+	return nil
+}
+
+// onlyFile returns the index of the manifest's single file, for receivers that can
+// only take one.
+func (m *transferManifest) onlyFile() (int, error) {
+	index := -1
+	for i, e := range m.Entries {
+		if e.IsDir {
+			continue
+		}
+		if index >= 0 {
+			return 0, fmt.Errorf("the sender offers several files, which cannot all go to standard output")
+		}
+		index = i
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("the sender offers no file to write to standard output")
+	}
+	return index, nil
+}
+
+// sourceFile pairs a manifest entry with the local path it is read from, the reader it
+// streams from when the size is not known in advance, or the text it holds in memory.
+type sourceFile struct {
+	meta   fileMetadata
+	path   string
+	stream io.Reader
+	text   []byte
+}
+
+// open returns the content of an entry with a known size.
+func (f sourceFile) open() (io.ReadCloser, error) {
+	if f.meta.Text {
+		return io.NopCloser(bytes.NewReader(f.text)), nil
+	}
+	return os.Open(f.path)
+}
+
+// collectSources expands the paths and glob patterns given on the command line and
+// collects the entries for all of them. Top-level names must be unique, since they all
+// land in the same output directory on the receiving side.
+func collectSources(paths []string) ([]sourceFile, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no files to send")
+	}
+	if slices.Contains(paths, stdinPath) {
+		if len(paths) > 1 {
+			return nil, fmt.Errorf("standard input (-) can't be combined with other files")
+		}
+		return []sourceFile{stdinSource()}, nil
+	}
+
+	var files []sourceFile
+	seen := make(map[string]string)
+	for _, pattern := range paths {
+		roots, err := expandPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, root := range roots {
+			entries, err := collectFiles(root)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if prev, ok := seen[e.meta.Name]; ok {
+					return nil, fmt.Errorf("%s and %s would both be received as %q", prev, e.path, e.meta.Name)
+				}
+				seen[e.meta.Name] = e.path
+			}
+			files = append(files, entries...)
+		}
+	}
+	return files, nil
+}
+
+// expandPattern resolves a glob pattern to the matching paths. Shells usually expand
+// globs already, but Windows shells do not, and quoted patterns reach us unexpanded.
+// A path that exists as typed is used literally, even if it contains glob characters.
+func expandPattern(pattern string) ([]string, error) {
+	if _, err := os.Lstat(pattern); err == nil {
+		return []string{pattern}, nil
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("file not found: %s", pattern)
+	}
+	return matches, nil
+}
+
+// collectFiles builds the list of entries for a file or a directory tree.
+// Directories are walked recursively and their entries are named relative to the
+// directory's parent, so the receiver recreates the top-level folder as well.
+func collectFiles(root string) ([]sourceFile, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("file not found: %s", root)
+		}
+		return nil, fmt.Errorf("could not access file: %w", err)
+	}
+
+	if !info.IsDir() {
+		name := filepath.Base(root)
+		if err := checkName(name); err != nil {
+			return nil, fmt.Errorf("cannot send %s: the receiver would refuse its %w", root, err)
+		}
+		return []sourceFile{{
+			meta: fileMetadata{Name: name, Size: info.Size()},
+			path: root,
+		}}, nil
+	}
+
+	// The top-level folder is named after the resolved directory, so "." and ".." are
+	// sent under their real names rather than as paths the receiver must refuse.
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", root, err)
+	}
+	top := filepath.Base(abs)
+	if top == string(filepath.Separator) {
+		return nil, fmt.Errorf("cannot send %s: the root directory has no name to send it under", root)
+	}
+	if err := checkName(top); err != nil {
+		return nil, fmt.Errorf("cannot send %s: the receiver would refuse its %w", root, err)
+	}
+
+	var files []sourceFile
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(top, rel))
+		if err := checkName(name); err != nil {
+			// Names that are fine here may not be elsewhere, such as "notes 10:30.txt".
+			fmt.Fprintf(os.Stderr, "⚠️  Skipping %s (the receiver would refuse its %v)\n", path, err)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			files = append(files, sourceFile{meta: fileMetadata{Name: name, IsDir: true}, path: path})
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			// Symlinks, sockets and devices have no portable meaning on the other side.
+			fmt.Fprintf(os.Stderr, "⚠️  Skipping %s (not a regular file)\n", path)
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{meta: fileMetadata{Name: name, Size: fi.Size()}, path: path})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk directory: %w", err)
+	}
+
+	return files, nil
+}
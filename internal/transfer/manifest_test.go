@@ -0,0 +1,87 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestCollectFilesNamesRelativeRoots checks that "." and ".." are sent under the name of
+// the directory they stand for, never as paths the receiver has to refuse.
+func TestCollectFilesNamesRelativeRoots(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "project")
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cwd, root string
+		want      []string
+	}{
+		{dir, ".", []string{"project", "project/src", "project/src/main.go"}},
+		{filepath.Join(dir, "src"), "..", []string{"project", "project/src", "project/src/main.go"}},
+		{filepath.Join(dir, "src"), ".", []string{"src", "src/main.go"}},
+		{filepath.Dir(dir), "project/src/", []string{"src", "src/main.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.root, func(t *testing.T) {
+			t.Chdir(tt.cwd)
+			files, err := collectFiles(tt.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range files {
+				got = append(got, f.meta.Name)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got entries %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got entries %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestCollectFilesSkipsUnsendableNames checks that names the receiver would refuse are
+// caught on this side: skipped inside a directory, and an error when named directly.
+func TestCollectFilesSkipsUnsendableNames(t *testing.T) {
+	silenceOutput(t)
+	dir := filepath.Join(t.TempDir(), "notes")
+	for _, name := range []string{"ok.txt", "notes 10:30.txt", `back\slash.txt`, ".lancrypt-x.resume", filepath.Join("a:b", "inner.txt"), filepath.Join("sub", "fine.txt")} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := collectFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.meta.Name)
+	}
+	want := []string{"notes", "notes/ok.txt", "notes/sub", "notes/sub/fine.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got entries %q, want %q", got, want)
+	}
+
+	for _, root := range []string{filepath.Join(dir, "notes 10:30.txt"), filepath.Join(dir, "a:b")} {
+		if _, err := collectFiles(root); err == nil || !strings.Contains(err.Error(), root) {
+			t.Errorf("collectFiles(%q) = %v, want an error naming it", root, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// ConflictPolicy decides what happens when an incoming file already exists.
+type ConflictPolicy string
+
+const (
+	ConflictRename    ConflictPolicy = "rename"    // Save as "name (1).ext" instead.
+	ConflictSkip      ConflictPolicy = "skip"      // Keep the existing file and don't download.
+	ConflictOverwrite ConflictPolicy = "overwrite" // Replace the existing file.
+	ConflictPrompt    ConflictPolicy = "prompt"    // Ask for every conflicting file.
+)
+
+// partSuffix marks files that are still being received. Data is only moved to its
+// final name once the file's trailer has been verified.
+const partSuffix = ".lancrypt-part"
+
+// ParseConflictPolicy validates a conflict policy given on the command line.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(s)); p {
+	case ConflictRename, ConflictSkip, ConflictOverwrite, ConflictPrompt:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q (use rename, skip, overwrite or prompt)", s)
+}
+
+// outputTarget is where a manifest entry ends up on this side of the transfer.
+type outputTarget struct {
+	path string // Final path inside the output directory.
+	skip bool   // The file already exists and is not downloaded.
+}
+
+// partPath returns the temporary file a target is received into.
+func (t outputTarget) partPath() string {
+	dir, base := filepath.Split(t.path)
+	return filepath.Join(dir, "."+base+partSuffix)
+}
+
+// sanitizeName strictly validates an entry name supplied by the peer and converts it
+// to a relative local path. Anything that could escape the output directory, or that
+// would mean something different on another platform, is refused.
+func sanitizeName(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", fmt.Errorf("refusing %w from peer", err)
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// checkName reports why an entry name can't be received safely on every platform, if
+// it can't. The sender runs it too, so such files are left out before the peer has to
+// refuse the whole transfer.
+func checkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty path")
+	}
+	parts := strings.Split(name, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("unsafe path %q", name)
+		}
+		if strings.ContainsAny(part, `\:`) || strings.IndexFunc(part, unicode.IsControl) >= 0 {
+			return fmt.Errorf("path %q with a backslash, colon or control character", name)
+		}
+	}
+	base := parts[len(parts)-1]
+	if strings.HasPrefix(base, ".lancrypt-") || strings.HasSuffix(base, partSuffix) {
+		return fmt.Errorf("reserved file name %q", name)
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("unsafe path %q", name)
+	}
+	return nil
+}
+
+// checkNoSymlinks makes sure no directory between outDir and rel is a symlink, so a
+// pre-existing link cannot redirect writes outside the output directory.
+func checkNoSymlinks(outDir, rel string) error {
+	dir := outDir
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %s", dir)
+		}
+	}
+	return nil
+}
+
+// planOutputs resolves the final path of every manifest entry from index from onwards,
+// applying the conflict policy to files that already exist. Excluded entries are
+// skipped without looking at them.
+func planOutputs(ctx context.Context, outDir string, manifest transferManifest, from int, policy ConflictPolicy, excluded map[int]bool) ([]outputTarget, error) {
+	targets := make([]outputTarget, len(manifest.Entries))
+	reserved := make(map[string]bool)
+	for i, meta := range manifest.Entries {
+		rel, err := sanitizeName(meta.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkNoSymlinks(outDir, rel); err != nil {
+			return nil, err
+		}
+		targets[i].path = filepath.Join(outDir, rel)
+		reserved[targets[i].path] = true
+	}
+
+	for i, meta := range manifest.Entries {
+		if meta.IsDir || i < from {
+			continue
+		}
+		if excluded[i] {
+			targets[i].skip = true
+			continue
+		}
+		info, err := os.Lstat(targets[i].path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		choice := policy
+		if choice == ConflictPrompt {
+			if choice, err = promptConflict(ctx, meta.Name); err != nil {
+				return nil, err
+			}
+		}
+		if choice == ConflictOverwrite && info.IsDir() {
+			return nil, fmt.Errorf("cannot overwrite directory %s with a file", targets[i].path)
+		}
+
+		switch choice {
+		case ConflictSkip:
+			targets[i].skip = true
+			fmt.Fprintf(os.Stderr, "⏭️  Skipping %s (already exists)\n", meta.Name)
+		case ConflictRename:
+			targets[i].path = freeName(targets[i].path, reserved)
+			reserved[targets[i].path] = true
+			fmt.Fprintf(os.Stderr, "✏️  %s already exists, saving as %s\n", meta.Name, filepath.Base(targets[i].path))
+		}
+	}
+	return targets, nil
+}
+
+// freeName finds the first "name (n).ext" next to path that is not taken.
+func freeName(path string, reserved map[string]bool) string {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) && !reserved[candidate] {
+			return candidate
+		}
+	}
+}
+
+// promptConflict asks what to do with an incoming file that already exists.
+func promptConflict(ctx context.Context, name string) (ConflictPolicy, error) {
+	for {
+		input, err := readAnswer(ctx, fmt.Sprintf("⚠️  %s already exists. [o]verwrite, [r]ename or [s]kip? ", name))
+		if err != nil {
+			return "", fmt.Errorf("could not read answer: %w", err)
+		}
+		switch input {
+		case "o", "overwrite":
+			return ConflictOverwrite, nil
+		case "r", "rename":
+			return ConflictRename, nil
+		case "s", "skip":
+			return ConflictSkip, nil
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSanitizeName checks which names from the peer are accepted, and that nothing
+// accepted can leave the output directory or clash with our own files.
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // Local path, or empty if the name must be refused.
+	}{
+		{"report.pdf", "report.pdf"},
+		{"project/src/main.go", filepath.Join("project", "src", "main.go")},
+		{".hidden", ".hidden"},
+		{"name with spaces (1).txt", "name with spaces (1).txt"},
+		{"über/naïve.txt", filepath.Join("über", "naïve.txt")},
+
+		// Traversal and absolute paths.
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../etc/passwd", ""},
+		{"project/../../etc/passwd", ""},
+		{"project/./main.go", ""},
+		{"/etc/passwd", ""},
+		{"project//main.go", ""},
+		{"project/", ""},
+
+		// Separators and drive letters of other platforms.
+		{`..\windows\system32`, ""},
+		{`project\main.go`, ""},
+		{"C:evil.txt", ""},
+		{"C:/evil.txt", ""},
+
+		// Control characters, which could also tamper with the terminal.
+		{"evil\x00.txt", ""},
+		{"evil\n.txt", ""},
+		{"\x1b[2Jevil.txt", ""},
+		{"evil\u0085.txt", ""},
+
+		// Names reserved for our own temporary files and journals.
+		{".lancrypt-maple-otter-violin-harbor.resume", ""},
+		{"project/.lancrypt-x", ""},
+		{".report.pdf" + partSuffix, ""},
+		{"project/report.pdf" + partSuffix, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeName(tt.name)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("sanitizeName(%q) = %q, want an error", tt.name, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeName(%q) failed: %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+			if !filepath.IsLocal(got) {
+				t.Errorf("sanitizeName(%q) = %q, which is not local", tt.name, got)
+			}
+		})
+	}
+}
+
+// TestCheckNoSymlinks checks that a symlink anywhere between the output directory and a
+// file is refused, while real directories and ones still to be created pass.
+func TestCheckNoSymlinks(t *testing.T) {
+	outDir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outDir, "real", "nested"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(outDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(outDir, "real", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel string
+		ok  bool
+	}{
+		{"file.txt", true},
+		{filepath.Join("real", "file.txt"), true},
+		{filepath.Join("real", "nested", "file.txt"), true},
+		{filepath.Join("missing", "deeper", "file.txt"), true},
+		{filepath.Join("link", "file.txt"), false},
+		{filepath.Join("link", "deeper", "file.txt"), false},
+		{filepath.Join("real", "link", "file.txt"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			if err := checkNoSymlinks(outDir, tt.rel); (err == nil) != tt.ok {
+				t.Errorf("checkNoSymlinks(%q) = %v, want ok=%v", tt.rel, err, tt.ok)
+			}
+		})
+	}
+}
+
+// TestPlanOutputs checks that every entry lands inside the output directory and that
+// the conflict policy applies to existing files only.
+func TestPlanOutputs(t *testing.T) {
+	silenceOutput(t)
+	outDir := t.TempDir()
+	for _, name := range []string{"taken.txt", "taken (1).txt"} {
+		if err := os.WriteFile(filepath.Join(outDir, name), []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(outDir, "folder"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := transferManifest{Entries: []fileMetadata{
+		{Name: "dir", IsDir: true},
+		{Name: "dir/new.txt"},
+		{Name: "taken.txt"},
+		{Name: "folder"},
+	}}
+	tests := []struct {
+		policy ConflictPolicy
+		taken  outputTarget
+		ok     bool // Whether the plan succeeds, given "folder" exists as a directory.
+	}{
+		{ConflictRename, outputTarget{path: filepath.Join(outDir, "taken (2).txt")}, true},
+		{ConflictSkip, outputTarget{path: filepath.Join(outDir, "taken.txt"), skip: true}, true},
+		{ConflictOverwrite, outputTarget{path: filepath.Join(outDir, "taken.txt")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			targets, err := planOutputs(context.Background(), outDir, manifest, 0, tt.policy, nil)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("overwriting a directory with a file was not refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (outputTarget{path: filepath.Join(outDir, "dir", "new.txt")}); targets[1] != want {
+				t.Errorf("new file: got %+v, want %+v", targets[1], want)
+			}
+			if targets[2] != tt.taken {
+				t.Errorf("existing file: got %+v, want %+v", targets[2], tt.taken)
+			}
+		})
+	}
+
+	t.Run("excluded and resumed", func(t *testing.T) {
+		targets, err := planOutputs(context.Background(), outDir, manifest, 2, ConflictOverwrite, map[int]bool{3: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Entries before the resume point and excluded ones are not checked for conflicts.
+		if want := (outputTarget{path: filepath.Join(outDir, "folder"), skip: true}); targets[3] != want {
+			t.Errorf("excluded entry: got %+v, want %+v", targets[3], want)
+		}
+	})
+
+	t.Run("renames don't collide", func(t *testing.T) {
+		dup := transferManifest{Entries: []fileMetadata{{Name: "taken.txt"}, {Name: "taken (2).txt"}}}
+		targets, err := planOutputs(context.Background(), outDir, dup, 0, ConflictRename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if targets[0].path == targets[1].path {
+			t.Errorf("both entries are written to %s", targets[0].path)
+		}
+	})
+}
+
+// TestPlanOutputsRefusesUnsafeEntries checks that one bad entry refuses the whole plan,
+// before anything is written.
+func TestPlanOutputsRefusesUnsafeEntries(t *testing.T) {
+	outDir := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(outDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []string{"../escape.txt", "link/escape.txt", ".lancrypt-x.resume", "evil\x1b.txt"}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			manifest := transferManifest{Entries: []fileMetadata{{Name: "fine.txt"}, {Name: name}}}
+			if _, err := planOutputs(context.Background(), outDir, manifest, 0, ConflictOverwrite, nil); err == nil {
+				t.Fatalf("planOutputs accepted %q", name)
+			}
+			entries, err := os.ReadDir(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if !strings.HasPrefix(e.Name(), "link") {
+					t.Errorf("planOutputs created %s", e.Name())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/sumanthd032/lancrypt/pkg/util"
+)
+
+// stdinPath is the argument that makes the sender read from standard input.
+const stdinPath = "-"
+
+// stdinSource returns the entry for data piped into the sender. Its size is only
+// known once the pipe is drained, so it is sent as a stream.
+func stdinSource() sourceFile {
+	return sourceFile{meta: fileMetadata{Name: "stdin", Stream: true}, stream: os.Stdin}
+}
+
+// streaming reports whether the files are a single stream of unknown size.
+func streaming(files []sourceFile) bool {
+	return len(files) == 1 && files[0].meta.Stream
+}
+
+// useTerminal points the prompts at the controlling terminal, for when standard input
+// carries the data being sent.
+func useTerminal() error {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	tty, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("standard input is being sent and there is no terminal to confirm the SAS on; use --pake instead")
+	}
+	stdin = bufio.NewReader(tty)
+	return nil
+}
+
+// receiveToWriter receives a single file's content into w, in order, with no part
+// file and no journal. Whatever was written before a failure can't be taken back, so
+// the caller must report the error to whoever consumes w.
+func receiveToWriter(ctx context.Context, readers []*FrameReader, index int, meta fileMetadata, w io.Writer, format chunkFormat, aead cipher.AEAD, chunkIndex *uint64) error {
+	bar := util.NewProgressBar(meta.progressSize(), fmt.Sprintf("Receiving %s", meta.Name))
+	defer bar.Finish()
+
+	chunks := &fileChunks{readers: readers, meta: meta, format: format, aead: aead, first: *chunkIndex}
+	h := sha256.New()
+	var offset int64
+	writeChunk := func(j *chunkJob) error {
+		if err := chunks.follow(j); err != nil {
+			return err
+		}
+		if _, err := w.Write(j.data); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		*chunkIndex = j.counter + 1
+		h.Write(j.data)
+		offset += int64(len(j.data))
+		bar.Add(len(j.data))
+		return nil
+	}
+
+	if err := newPipeline(format.size).run(ctx, chunks.first, chunks.producers(), chunks.open, writeChunk); err != nil {
+		return err
+	}
+	trailer, err := chunks.trailer(index)
+	if err != nil {
+		return err
+	}
+	return verifyTrailer(trailer, meta, offset, h)
+}
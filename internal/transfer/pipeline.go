@@ -0,0 +1,159 @@
+package transfer
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// pipelineMemory caps the chunk buffers a pipeline keeps in flight.
+const pipelineMemory = 64 * 1024 * 1024
+
+// chunkJob is one chunk on its way through a pipeline.
+type chunkJob struct {
+	counter uint64  // Chunk index the chunk is sealed under, which also fixes its order.
+	buf     *[]byte // Pooled buffer holding the chunk.
+	data    []byte  // The part of buf the next stage works on.
+	size    int     // File bytes in the chunk, for progress reporting.
+	err     error   // Set by process if the chunk could not be handled.
+}
+
+// pipeline runs the AEAD work of a chunk stream on every core. Producers read chunks,
+// a pool of workers processes them in parallel, and the caller consumes the results
+// in chunk order. The window bounds how far ahead of the consumer a chunk may be, so a
+// slow consumer throttles the producers instead of buffering the file.
+type pipeline struct {
+	workers int
+	window  uint64
+}
+
+// newPipeline sizes a pipeline for chunks of the given size.
+func newPipeline(chunkSize int) *pipeline {
+	workers := runtime.GOMAXPROCS(0)
+	window := min(4*workers, max(4, pipelineMemory/chunkSize))
+	return &pipeline{workers: workers, window: uint64(window)}
+}
+
+// run drives the pipeline over the chunks first, first+1, ... until every producer is
+// done, a stage fails or ctx is done. Producers may run concurrently and emit in any
+// order; each must stop when emit returns false. process runs on the workers, consume
+// on the calling goroutine, in chunk order. The first error wins.
+func (p *pipeline) run(ctx context.Context, first uint64, producers []func(emit func(*chunkJob) bool) error, process func(*chunkJob), consume func(*chunkJob) error) error {
+	jobs := make(chan *chunkJob, p.window)
+	results := make(chan *chunkJob, p.window)
+
+	// A chunk may only enter once it is within the window of the next one to be
+	// consumed. Gating on the position rather than on a count means the chunk the
+	// consumer waits for can always get in, whichever producer holds it.
+	var mu sync.Mutex
+	admitted := sync.NewCond(&mu)
+	next := first
+	stopped := false
+	emit := func(j *chunkJob) bool {
+		mu.Lock()
+		for j.counter >= next+p.window && !stopped {
+			admitted.Wait()
+		}
+		ok := !stopped
+		mu.Unlock()
+		if ok {
+			jobs <- j
+		}
+		return ok
+	}
+	stop := func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		admitted.Broadcast()
+	}
+
+	var produceErr error
+	failed := make(chan struct{})
+	var producing sync.WaitGroup
+	for _, produce := range producers {
+		producing.Add(1)
+		go func() {
+			defer producing.Done()
+			if err := produce(emit); err != nil {
+				mu.Lock()
+				if produceErr == nil {
+					produceErr = err
+					close(failed)
+				}
+				mu.Unlock()
+				stop()
+			}
+		}()
+	}
+	go func() {
+		producing.Wait()
+		close(jobs)
+	}()
+
+	var working sync.WaitGroup
+	for range p.workers {
+		working.Add(1)
+		go func() {
+			defer working.Done()
+			for j := range jobs {
+				process(j)
+				results <- j
+			}
+		}()
+	}
+	go func() {
+		working.Wait()
+		close(results)
+	}()
+
+	// Results arrive in any order; hold them back until their turn comes. On failure
+	// the producers are told to stop; the results still in flight fit in their
+	// channel, so no goroutine is left blocked. Once ctx is done or a producer has
+	// failed the pipeline stops at once, even while another producer is stuck reading
+	// its input.
+	pending := make(map[uint64]*chunkJob)
+	for {
+		var j *chunkJob
+		select {
+		case <-ctx.Done():
+			stop()
+			return context.Cause(ctx)
+		case <-failed:
+			mu.Lock()
+			defer mu.Unlock()
+			return produceErr
+		case j = <-results:
+		}
+		if j == nil {
+			break
+		}
+		pending[j.counter] = j
+		for {
+			j, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, j.counter)
+
+			err := j.err
+			if err == nil {
+				err = consume(j)
+			}
+			if err != nil {
+				stop()
+				return err
+			}
+			chunkPool.Put(j.buf)
+
+			mu.Lock()
+			next++
+			mu.Unlock()
+			admitted.Broadcast()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return produceErr
+}
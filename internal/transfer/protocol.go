@@ -1,143 +1,1008 @@
 package transfer
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math/bits"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
-	"github.com/sumanthd032/lancrypt/pkg/crypto"
 	"github.com/sumanthd032/lancrypt/pkg/util"
 )
 
-// fileMetadata holds information about the file being transferred.
-type fileMetadata struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
+// Bounds for the amount of file data sealed into each chunk. Peers propose a size in
+// their hello and use the smaller of the two.
+const (
+	MinChunkSize     = 64 * 1024
+	MaxChunkSize     = 4 * 1024 * 1024
+	DefaultChunkSize = 1024 * 1024
+)
+
+// CheckChunkSize reports whether n is an acceptable chunk size.
+func CheckChunkSize(n int) error {
+	if n < MinChunkSize || n > MaxChunkSize {
+		return fmt.Errorf("chunk size must be between %s and %s", util.FormatBytes(MinChunkSize), util.FormatBytes(MaxChunkSize))
+	}
+	return nil
+}
+
+// chunkPool recycles chunk buffers between files, which matters with large chunks
+// and many small files.
+var chunkPool sync.Pool
+
+// getChunkBuffer returns a buffer of n bytes, from the pool when one is big enough.
+func getChunkBuffer(n int) *[]byte {
+	if buf, ok := chunkPool.Get().(*[]byte); ok && cap(*buf) >= n {
+		*buf = (*buf)[:n]
+		return buf
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+// manifestBlock is the granularity the encrypted manifest is padded to, so the length
+// of its frame does not give away the length of the file names inside.
+const manifestBlock = 512
+
+// resumePoint identifies where in the manifest a transfer starts.
+type resumePoint struct {
+	File   int    `json:"file"`   // Index of the first manifest entry still to be sent.
+	Offset int64  `json:"offset"` // Bytes of that entry the receiver already holds.
+	Chunk  uint64 `json:"chunk"`  // Chunk index to continue counting from.
+
+	Streams int `json:"streams,omitempty"` // Data connections the sender will use, if more than one.
+}
+
+// transferRequest is sent by the receiver once it has seen the manifest.
+type transferRequest struct {
+	Resume  resumePoint `json:"resume"`
+	Digest  []byte      `json:"digest,omitempty"`  // SHA-256 of the first Offset bytes of the entry.
+	Skip    []int       `json:"skip,omitempty"`    // Manifest entries the receiver does not want.
+	Decline bool        `json:"decline,omitempty"` // The receiver refused the whole transfer.
+
+	StreamPort int `json:"stream_port,omitempty"` // Where the receiver accepts extra data connections.
+}
+
+// errDeclined is returned when the receiver turns the transfer down.
+var errDeclined = errors.New("the receiver declined the transfer")
+
+// fileTrailer follows the last chunk of every file. It binds the whole stream, so a
+// truncated or spliced file is detected even though each chunk authenticates on its own.
+type fileTrailer struct {
+	Size   int64  `json:"size"`
+	Digest []byte `json:"sha256"`
+}
+
+// setNonce fills nonce with a counter in the nonce domain of a message type. Every
+// kind of sealed message gets its own nonce sequence under the session key, so a
+// control message can never reuse the nonce of a file chunk.
+func setNonce(nonce []byte, t msgType, counter uint64) {
+	clear(nonce)
+	binary.LittleEndian.PutUint64(nonce, counter)
+	nonce[len(nonce)-1] = byte(t)
+}
+
+// writeSealed encodes v as JSON, seals it and sends it as a frame of the given type.
+func writeSealed(w *FrameWriter, aead cipher.AEAD, t msgType, counter uint64, v any) error {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeSealedBytes(w, aead, t, counter, plaintext)
+}
+
+// writeSealedBytes seals plaintext and sends it as a frame of the given type.
+func writeSealedBytes(w *FrameWriter, aead cipher.AEAD, t msgType, counter uint64, plaintext []byte) error {
+	nonce := make([]byte, aead.NonceSize())
+	setNonce(nonce, t, counter)
+	return w.WriteSealed(t, aead, nonce, plaintext)
+}
+
+// readSealed reads a frame written by writeSealed and decodes it into v.
+func readSealed(r *FrameReader, aead cipher.AEAD, t msgType, counter uint64, v any) error {
+	sealed, err := r.Expect(t)
+	if err != nil {
+		return err
+	}
+	return openSealed(aead, t, counter, sealed, v)
+}
+
+// openSealed authenticates the payload of a sealed frame and decodes it into v.
+func openSealed(aead cipher.AEAD, t msgType, counter uint64, sealed []byte, v any) error {
+	nonce := make([]byte, aead.NonceSize())
+	setNonce(nonce, t, counter)
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return fmt.Errorf("could not authenticate %s message: %w", t, err)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// chunkFormat describes how file data is cut into chunks during a session. Both sides
+// derive it from the manifest and the negotiated chunk size.
+type chunkFormat struct {
+	size       int  // Plaintext bytes per chunk.
+	padded     bool // File streams are padded with zeros to their Padmé size.
+	compressed bool // Every chunk starts with a compression flag.
+}
+
+// sendConfig controls how files are sent.
+type sendConfig struct {
+	Pad      bool            // Pad file streams so exact sizes don't leak.
+	Streams  int             // Data connections to spread chunks over.
+	Compress CompressionMode // Whether to compress file data before encrypting it.
+	Started  func()          // Called once the receiver has accepted the transfer, if set.
+}
+
+// padmeSize rounds a length up using the Padmé scheme, which leaks only O(log log n)
+// bits of the original length while adding at most 12% overhead.
+func padmeSize(n int64) int64 {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len64(uint64(n)) - 1 // floor(log2(n))
+	s := bits.Len64(uint64(e))     // floor(log2(e)) + 1
+	mask := int64(1)<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// sendFiles sends the manifest and every file over an established session. It reports
+// whether the receiver accepted the transfer.
+func sendFiles(ctx context.Context, conn net.Conn, files []sourceFile, sess *session, cfg sendConfig) (started bool, err error) {
+	r, w := NewFrameReader(conn), NewFrameWriter(conn)
+	r.WatchAbort(sess.recv)
+	var extra []net.Conn
+	// Once ctx is done the receiver is sent an abort; the caller interrupts reads on conn.
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			abortSession(conn, sess)
+			err = context.Cause(ctx)
+		}
+		closeAll(extra)
+	}()
+	if len(files) > 1 && !sess.peer.has(capMultiFile) {
+		return false, fmt.Errorf("the receiver can only accept a single file")
+	}
+	pad, streams := cfg.Pad, cfg.Streams
+	if pad && !sess.peer.has(capPadding) {
+		fmt.Fprintln(os.Stderr, "⚠️  The receiver does not support padding, sending exact sizes")
+		pad = false
+	}
+
+	// Padding and parallel streams both rely on knowing the size up front, and the
+	// receiver finds the end of a stream by its trailer on the control connection.
+	if streaming(files) && (pad || streams > 1) {
+		fmt.Fprintln(os.Stderr, "⚠️  Standard input has no known size, sending it unpadded over a single connection")
+		pad, streams = false, 1
+	}
+
+	// The size of compressed chunks depends on their content, which is exactly what
+	// padding is meant to hide, so the two don't mix.
+	compress := cfg.Compress
+	if compress != CompressNone && !sess.peer.has(capZstd) {
+		compress = CompressNone
+	}
+	if compress != CompressNone && pad {
+		if compress == CompressZstd {
+			fmt.Fprintln(os.Stderr, "⚠️  Compression would leak what padding hides, sending uncompressed")
+		}
+		compress = CompressNone
+	}
+
+	// With padding, every file's stream is padded so its exact size does not leak.
+	manifest := transferManifest{Entries: make([]fileMetadata, len(files)), Padded: pad}
+	if compress != CompressNone {
+		manifest.Compression = compressionZstd
+	}
+	for i, f := range files {
+		manifest.Entries[i] = f.meta
+	}
+
+	// JSON ignores trailing whitespace, so the manifest is padded with spaces.
+	metaBytes, _ := json.Marshal(manifest)
+	padded := make([]byte, (len(metaBytes)/manifestBlock+1)*manifestBlock)
+	copy(padded, metaBytes)
+	for i := len(metaBytes); i < len(padded); i++ {
+		padded[i] = ' '
+	}
+	if err := writeSealedBytes(w, sess.send, msgManifest, 0, padded); err != nil {
+		return false, fmt.Errorf("could not send metadata: %w", err)
+	}
+
+	var req transferRequest
+	if err := readSealed(r, sess.recv, msgRequest, 0, &req); err != nil {
+		return false, fmt.Errorf("could not read transfer request: %w", err)
+	}
+	if req.Decline {
+		return false, errDeclined
+	}
+	// From here on an interruption can be resumed on a new connection.
+	if cfg.Started != nil {
+		cfg.Started()
+	}
+	skip := make(map[int]bool, len(req.Skip))
+	for _, i := range req.Skip {
+		skip[i] = true
+	}
+	resume := resumePoint{}
+	if sess.peer.has(capResume) {
+		resume = acceptResume(files, req)
+	}
+	if streams > 1 && (req.StreamPort == 0 || !sess.peer.has(capMultiStream)) {
+		fmt.Fprintln(os.Stderr, "⚠️  The receiver does not support parallel streams, using a single connection")
+		streams = 1
+	}
+	if streams > 1 {
+		resume.Streams = streams
+	}
+	if err := writeSealed(w, sess.send, msgResume, 0, resume); err != nil {
+		return false, fmt.Errorf("could not send resume point: %w", err)
+	}
+	if resume.File > 0 || resume.Offset > 0 {
+		fmt.Fprintf(os.Stderr, "↪️  Resuming at %s, offset %s\n", files[resume.File].meta.Name, util.FormatBytes(resume.Offset))
+	}
+
+	// With more than one stream, chunks are spread over extra connections to the receiver.
+	writers := []*FrameWriter{w}
+	if streams > 1 {
+		if extra, err = openStreams(conn, req.StreamPort, streams, sess.send); err != nil {
+			return true, err
+		}
+		for _, c := range extra {
+			writers = append(writers, NewFrameWriter(c))
+		}
+		fmt.Fprintf(os.Stderr, "🔀 Sending over %d parallel streams\n", streams)
+	}
+
+	// The receiver has nothing more to say until every file is in place, unless it
+	// cancels, so the control connection is watched for its abort while the files go
+	// out. It has stopped reading by then, so the abort also cuts off the writes.
+	sending, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	watched := make(chan error, 1)
+	go func() {
+		err := readDone(r, sess.recv)
+		if errors.Is(err, errPeerAborted) {
+			cancel(err)
+			for _, c := range append([]net.Conn{conn}, extra...) {
+				c.SetWriteDeadline(time.Now())
+			}
+		}
+		watched <- err
+	}()
+
+	// The chunk index keeps counting across files: every chunk in the session is
+	// sealed under the same key, so nonces must never repeat.
+	format := chunkFormat{size: sess.peer.chunkSize, padded: pad, compressed: manifest.Compression != ""}
+	chunkIndex := resume.Chunk
+	for i := resume.File; i < len(files); i++ {
+		if files[i].meta.IsDir || skip[i] {
+			continue
+		}
+		var offset int64
+		if i == resume.File {
+			offset = resume.Offset
+		}
+		// A stream can't be sampled ahead of time; chunks that don't shrink go out raw anyway.
+		worth := compress == CompressZstd || (compress == CompressAuto && (files[i].meta.Stream || worthCompressing(files[i].path, offset)))
+		if err := sendFile(sending, writers, files[i], i, offset, format, worth, sess.send, &chunkIndex); err != nil {
+			// A write can fail on a stream the receiver closed before its abort is read.
+			select {
+			case <-watched:
+			case <-time.After(abortTimeout):
+			}
+			if sending.Err() != nil {
+				return true, context.Cause(sending)
+			}
+			return true, err
+		}
+	}
+
+	// The last trailer may still be in a socket buffer, and the receiver may yet reject
+	// what it got, so the transfer is only over once the receiver says so.
+	if !sess.peer.has(capDone) {
+		return true, nil
+	}
+	if err := <-watched; err != nil {
+		if sending.Err() != nil {
+			return true, context.Cause(sending)
+		}
+		return true, fmt.Errorf("the receiver did not confirm the transfer: %w", err)
+	}
+	return true, nil
+}
+
+// readDone waits for the receiver's confirmation that every file arrived.
+func readDone(r *FrameReader, aead cipher.AEAD) error {
+	return readSealed(r, aead, msgDone, 0, &struct{}{})
+}
+
+// acceptResume checks the receiver's resume point against the local files. A point
+// that does not match what is on disk here restarts the affected entry from scratch.
+func acceptResume(files []sourceFile, req transferRequest) resumePoint {
+	resume := req.Resume
+	if resume.File < 0 || resume.File >= len(files) {
+		return resumePoint{Chunk: resume.Chunk}
+	}
+	if resume.Offset == 0 {
+		return resume
+	}
+
+	f := files[resume.File]
+	if f.meta.IsDir || f.meta.Stream || f.meta.Text || resume.Offset > f.meta.Size {
+		resume.Offset = 0
+		return resume
+	}
+	digest, err := prefixDigest(f.path, resume.Offset)
+	if err != nil || string(digest) != string(req.Digest) {
+		fmt.Fprintf(os.Stderr, "⚠️  Partial copy of %s does not match, sending it again\n", f.meta.Name)
+		resume.Offset = 0
+	}
+	return resume
 }
 
-// sendFile handles the logic for sending the file's content after a secure connection is established.
-func sendFile(conn net.Conn, filePath string, sharedSecret *[32]byte) error {
-	file, err := os.Open(filePath)
+// prefixDigest hashes the first n bytes of a file.
+func prefixDigest(path string, n int64) ([]byte, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("could not open file: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
-	fileInfo, _ := file.Stat()
-	meta := fileMetadata{
-		Name: filepath.Base(filePath),
-		Size: fileInfo.Size(),
+	h := sha256.New()
+	if _, err := io.CopyN(h, file, n); err != nil {
+		return nil, err
 	}
+	return h.Sum(nil), nil
+}
 
-	metaBytes, _ := json.Marshal(meta)
-	if err := binary.Write(conn, binary.LittleEndian, uint32(len(metaBytes))); err != nil {
-		return fmt.Errorf("could not send metadata size: %w", err)
+// chunkCount returns how many chunks carry a file from offset on. Both sides work it
+// out from the manifest, so every stream knows which chunks it carries.
+func chunkCount(meta fileMetadata, offset int64, format chunkFormat) uint64 {
+	total := meta.Size
+	if format.padded {
+		total = padmeSize(total)
 	}
-	if _, err := conn.Write(metaBytes); err != nil {
-		return fmt.Errorf("could not send metadata: %w", err)
+	return uint64((total - offset + int64(format.size) - 1) / int64(format.size))
+}
+
+// zeroReader reads an endless run of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// sendFile streams a single file's content, starting at offset, as encrypted chunks
+// followed by the authenticated trailer. Chunk n travels on stream n modulo the
+// number of writers; the trailer always goes over the control connection. With
+// compress set, each chunk is compressed before it is sealed. A stream of unknown
+// size is read until it ends, and its trailer carries the size that was sent.
+func sendFile(ctx context.Context, writers []*FrameWriter, f sourceFile, index int, offset int64, format chunkFormat, compress bool, aead cipher.AEAD, chunkIndex *uint64) error {
+	h := sha256.New()
+	var data io.Reader
+	total := f.meta.Size
+	if f.meta.Stream {
+		data = io.TeeReader(f.stream, h)
+	} else {
+		file, err := f.open()
+		if err != nil {
+			return fmt.Errorf("could not open file: %w", err)
+		}
+		defer file.Close()
+
+		// The trailer digest covers the whole file, so a resumed transfer hashes the
+		// part the receiver already has; this also leaves the file at the resume point.
+		if _, err := io.CopyN(h, file, offset); err != nil {
+			return fmt.Errorf("could not seek to resume point: %w", err)
+		}
+
+		// Exactly the size announced in the manifest is sent, followed by zeros when
+		// padding, so every chunk but the last is full and the receiver can place each
+		// one by its index. The receiver drops everything past the real size.
+		if format.padded {
+			total = padmeSize(total)
+		}
+		data = io.MultiReader(
+			io.TeeReader(io.LimitReader(file, f.meta.Size-offset), h),
+			io.LimitReader(zeroReader{}, total-f.meta.Size),
+		)
 	}
 
-	bar := util.NewProgressBar(meta.Size, fmt.Sprintf("Sending %s", meta.Name))
+	bar := util.NewProgressBar(f.meta.progressSize(), fmt.Sprintf("Sending %s", f.meta.Name))
 	defer bar.Finish()
+	bar.Set64(offset)
 
-	aead, err := crypto.NewAESGCM(sharedSecret)
-	if err != nil {
-		return fmt.Errorf("could not create cipher: %w", err)
+	// Chunks are read straight into a frame buffer, behind the compression flag if
+	// there is one, and sealed in place, so the workers hand the writer a complete frame.
+	first := *chunkIndex
+	chunkSize := format.size
+	lead := frameHeaderSize
+	if format.compressed {
+		lead++
 	}
+	frameSize := lead + chunkSize + aead.Overhead()
+	pos := offset
+	readChunks := func(emit func(*chunkJob) bool) error {
+		for f.meta.Stream || pos < total {
+			buf := getChunkBuffer(frameSize)
+			n, err := io.ReadFull(data, (*buf)[lead:lead+chunkSize])
+			ended := false
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if f.meta.Stream && n == 0 {
+					chunkPool.Put(buf)
+					return nil
+				}
+				if !f.meta.Stream && pos+int64(n) < total {
+					return fmt.Errorf("%s changed while it was being sent", f.meta.Name)
+				}
+				ended = true
+			} else if err != nil {
+				return fmt.Errorf("could not read file chunk: %w", err)
+			}
 
-	chunkBuffer := make([]byte, 4*1024)
-	nonce := make([]byte, aead.NonceSize())
-	var chunkIndex uint64 = 0
+			j := &chunkJob{counter: *chunkIndex, buf: buf, data: (*buf)[frameHeaderSize : lead+n], size: n}
+			if !f.meta.Stream {
+				j.size = int(max(0, min(int64(n), f.meta.Size-pos)))
+			}
+			if !emit(j) {
+				return nil
+			}
+			*chunkIndex++
+			pos += int64(n)
+			if ended {
+				return nil
+			}
+		}
+		return nil
+	}
 
-	for {
-		bytesRead, err := file.Read(chunkBuffer)
-		if err == io.EOF {
-			break
+	sealChunk := func(j *chunkJob) {
+		if format.compressed {
+			j.data[0] = chunkRaw
+			if compress {
+				scratch := getChunkBuffer(chunkSize)
+				j.data = compressChunk(j.data, *scratch)
+				chunkPool.Put(scratch)
+			}
 		}
+		nonce := make([]byte, aead.NonceSize())
+		setChunkNonce(nonce, streamOf(j.counter, len(writers)), j.counter)
+		j.data, j.err = appendSealedFrame((*j.buf)[:0], msgChunk, aead, nonce, j.data)
+	}
+
+	writeChunk := func(j *chunkJob) error {
+		if err := writers[streamOf(j.counter, len(writers))].WriteRaw(j.data); err != nil {
+			return fmt.Errorf("could not send chunk: %w", err)
+		}
+		bar.Add(j.size)
+		return nil
+	}
+
+	producers := []func(func(*chunkJob) bool) error{readChunks}
+	if err := newPipeline(chunkSize).run(ctx, first, producers, sealChunk, writeChunk); err != nil {
+		return err
+	}
+
+	// The trailer frame also marks the end of the file's chunks.
+	trailer := fileTrailer{Size: f.meta.Size, Digest: h.Sum(nil)}
+	if f.meta.Stream {
+		trailer.Size = pos
+	}
+	if err := writeSealed(writers[0], aead, msgTrailer, uint64(index), trailer); err != nil {
+		return fmt.Errorf("could not send trailer: %w", err)
+	}
+	return nil
+}
+
+// receiveConfig controls where and how received files are written.
+type receiveConfig struct {
+	Code       string
+	OutDir     string
+	Policy     ConflictPolicy
+	AutoAccept bool // Download every file without asking first.
+	Stdout     bool // Write the transfer's only file to standard output instead.
+	SaveText   bool // Save a text snippet as a file instead of printing it.
+}
+
+// receiveFiles receives the manifest and rebuilds every entry inside the output directory.
+func receiveFiles(ctx context.Context, conn net.Conn, cfg receiveConfig, sess *session) (err error) {
+	r, w := NewFrameReader(conn), NewFrameWriter(conn)
+	r.SetLimit(msgChunk, sess.peer.chunkSize+chunkFlagSize+sealOverhead)
+	r.WatchAbort(sess.recv)
+
+	var manifest transferManifest
+	var journal *resumeJournal
+	var targets []outputTarget
+	var extra []net.Conn
+	// Once ctx is done the sender is sent an abort; the caller interrupts reads on conn.
+	// A cancelled transfer, on either side, won't be resumed, so its partial files go.
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			abortSession(conn, sess)
+			err = context.Cause(ctx)
+		}
+		closeAll(extra)
+		if err != nil && (ctx.Err() != nil || errors.Is(err, errPeerAborted)) {
+			discardPartial(journal, manifest, targets)
+		}
+	}()
+
+	if err := readSealed(r, sess.recv, msgManifest, 0, &manifest); err != nil {
+		return fmt.Errorf("could not read metadata: %w", err)
+	}
+	decline := func(reason error) error {
+		if err := writeSealed(w, sess.send, msgRequest, 0, transferRequest{Decline: true}); err != nil {
+			return fmt.Errorf("could not send transfer request: %w", err)
+		}
+		return reason
+	}
+	if manifest.Compression != "" && manifest.Compression != compressionZstd {
+		return fmt.Errorf("sender uses unsupported compression %q", manifest.Compression)
+	}
+	if err := manifest.validate(); err != nil {
+		return decline(err)
+	}
+	manifest.printSummary()
+
+	// Standard output and the terminal can only take a single file, and a text
+	// snippet is held in memory until it has been verified. Neither is resumed.
+	var single io.Writer
+	var text bytes.Buffer
+	singleIndex := -1
+	switch {
+	case cfg.Stdout:
+		single = os.Stdout
+	case manifest.isText() && !cfg.SaveText:
+		if manifest.Entries[0].Size > MaxTextSize {
+			return decline(fmt.Errorf("the text is too large to print; use --save to write it to a file"))
+		}
+		single = &text
+	}
+	if single != nil {
+		index, err := manifest.onlyFile()
 		if err != nil {
-			return fmt.Errorf("could not read file chunk: %w", err)
+			return decline(err)
 		}
+		singleIndex = index
+	}
 
-		binary.LittleEndian.PutUint64(nonce, chunkIndex)
-		encryptedChunk := aead.Seal(nil, nonce, chunkBuffer[:bytesRead], nil)
+	// Nothing touches the disk until the user has agreed to the files.
+	var excluded map[int]bool
+	if !cfg.AutoAccept {
+		var declined bool
+		var err error
+		excluded, declined, err = promptForAcceptance(ctx, manifest)
+		if err != nil {
+			return err
+		}
+		if declined {
+			return decline(fmt.Errorf("transfer declined"))
+		}
+	}
 
-		if err := binary.Write(conn, binary.LittleEndian, uint32(len(encryptedChunk))); err != nil {
-			return fmt.Errorf("could not send chunk size: %w", err)
+	var req transferRequest
+	if single != nil {
+		req.Resume.File = singleIndex
+	} else {
+		if err := os.MkdirAll(cfg.OutDir, 0o755); err != nil {
+			return fmt.Errorf("could not create output directory: %w", err)
 		}
-		if _, err := conn.Write(encryptedChunk); err != nil {
-			return fmt.Errorf("could not send chunk: %w", err)
+		// Progress is recorded in a resume journal, and an existing journal for the
+		// same code and manifest picks up where it left off.
+		if sess.peer.has(capResume) {
+			journal = loadJournal(cfg.OutDir, cfg.Code, manifest)
+		}
+		if journal == nil {
+			journal = newJournal(cfg.OutDir, cfg.Code, manifest)
+		}
+		var err error
+		if targets, err = planOutputs(ctx, cfg.OutDir, manifest, journal.File, cfg.Policy, excluded); err != nil {
+			return err
+		}
+		if req, err = resumeRequest(journal, targets); err != nil {
+			return err
+		}
+	}
+
+	// Offer a port for extra data connections; the sender decides whether to use it.
+	// A stream's end is only marked on the control connection, so it gets none.
+	var streamListener *net.TCPListener
+	if sess.peer.has(capMultiStream) && !manifest.streamed() {
+		if l, err := net.ListenTCP("tcp", nil); err == nil {
+			streamListener = l
+			defer l.Close()
+			req.StreamPort = l.Addr().(*net.TCPAddr).Port
 		}
-		chunkIndex++
-		bar.Add(bytesRead)
 	}
 
-	return binary.Write(conn, binary.LittleEndian, uint32(0)) // Send EOF signal
+	if err := writeSealed(w, sess.send, msgRequest, 0, req); err != nil {
+		return fmt.Errorf("could not send transfer request: %w", err)
+	}
+
+	var resume resumePoint
+	if err := readSealed(r, sess.recv, msgResume, 0, &resume); err != nil {
+		return fmt.Errorf("could not read resume point: %w", err)
+	}
+	if resume.File != req.Resume.File || (resume.Offset != req.Resume.Offset && resume.Offset != 0) {
+		return fmt.Errorf("sender sent an invalid resume point")
+	}
+	if resume.Offset != req.Resume.Offset && journal != nil {
+		journal.Offset, journal.Hash = 0, nil
+	}
+	if resume.File > 0 || resume.Offset > 0 {
+		fmt.Fprintf(os.Stderr, "↪️  Resuming at %s, offset %s\n", manifest.Entries[resume.File].Name, util.FormatBytes(resume.Offset))
+	}
+
+	readers := []*FrameReader{r}
+	if resume.Streams > 1 {
+		if streamListener == nil || resume.Streams > MaxStreams {
+			return fmt.Errorf("sender asked for an invalid number of streams")
+		}
+		if extra, err = acceptStreams(streamListener, resume.Streams, sess.recv); err != nil {
+			return err
+		}
+		defer interruptReads(ctx, extra...)()
+		for _, c := range extra {
+			sr := NewFrameReader(c)
+			sr.SetLimit(msgChunk, sess.peer.chunkSize+chunkFlagSize+sealOverhead)
+			readers = append(readers, sr)
+		}
+		fmt.Fprintf(os.Stderr, "🔀 Receiving over %d parallel streams\n", resume.Streams)
+	}
+
+	format := chunkFormat{size: sess.peer.chunkSize, padded: manifest.Padded, compressed: manifest.Compression != ""}
+	chunkIndex := resume.Chunk
+	if single != nil {
+		if err := receiveToWriter(ctx, readers, resume.File, manifest.Entries[resume.File], single, format, sess.recv, &chunkIndex); err != nil {
+			return err
+		}
+		confirmDone(w, sess)
+		if single == &text {
+			printText(text.Bytes())
+		}
+		return nil
+	}
+	for i, meta := range manifest.Entries {
+		received := false
+		if meta.IsDir {
+			if err := os.MkdirAll(targets[i].path, 0o755); err != nil {
+				return fmt.Errorf("could not create directory: %w", err)
+			}
+		} else if i >= resume.File && !targets[i].skip {
+			if err := receiveFile(ctx, readers, i, meta, targets[i], format, sess.recv, &chunkIndex, journal); err != nil {
+				return err
+			}
+			received = true
+		}
+		// Directories and skipped entries are cheap to go over again, so the journal is
+		// only written once a file has been moved into place.
+		if i >= journal.File {
+			journal.advance(chunkIndex)
+			if received {
+				if err := journal.save(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	journal.remove()
+	confirmDone(w, sess)
+	return nil
 }
 
-// receiveFile handles the logic for receiving a file's content.
-func receiveFile(conn net.Conn, sharedSecret *[32]byte) error {
-	var metaSize uint32
-	if err := binary.Read(conn, binary.LittleEndian, &metaSize); err != nil {
-		return fmt.Errorf("could not read metadata size: %w", err)
+// confirmDone tells the sender that every file arrived and was verified, so it can
+// stop waiting for a reconnect. The files are in place either way, so a failure only
+// warrants a warning.
+func confirmDone(w *FrameWriter, sess *session) {
+	if !sess.peer.has(capDone) {
+		return
+	}
+	if err := writeSealed(w, sess.send, msgDone, 0, struct{}{}); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  Could not tell the sender the transfer completed: %v\n", err)
 	}
+}
 
-	metaBytes := make([]byte, metaSize)
-	if _, err := io.ReadFull(conn, metaBytes); err != nil {
-		return fmt.Errorf("could not read metadata: %w", err)
+// discardPartial deletes what a cancelled transfer left behind: the part files of
+// every entry that was not completed, and the journal that would have resumed them.
+func discardPartial(journal *resumeJournal, manifest transferManifest, targets []outputTarget) {
+	if journal == nil {
+		return
 	}
+	for i := journal.File; i < len(targets); i++ {
+		if !manifest.Entries[i].IsDir && !targets[i].skip {
+			os.Remove(targets[i].partPath())
+		}
+	}
+	journal.remove()
+	fmt.Fprintln(os.Stderr, "🗑️  Removed the partial files.")
+}
 
-	var meta fileMetadata
-	if err := json.Unmarshal(metaBytes, &meta); err != nil {
-		return fmt.Errorf("could not decode metadata: %w", err)
+// resumeRequest builds the transfer request from the journal and the output plan.
+func resumeRequest(journal *resumeJournal, targets []outputTarget) (transferRequest, error) {
+	req := transferRequest{Resume: resumePoint{File: journal.File, Chunk: journal.Chunk}}
+	for i := journal.File; i < len(targets); i++ {
+		if targets[i].skip {
+			req.Skip = append(req.Skip, i)
+		}
+	}
+	if journal.Offset == 0 || targets[journal.File].skip {
+		journal.Offset, journal.Hash = 0, nil
+		return req, nil
 	}
 
-	file, err := os.Create(meta.Name)
+	// Only trust the journal's offset if the partial file on disk still holds exactly
+	// the bytes it verified.
+	h, err := journal.restoreHash()
+	if err != nil {
+		return transferRequest{}, err
+	}
+	digest, err := prefixDigest(targets[journal.File].partPath(), journal.Offset)
+	if err != nil || string(digest) != string(h.Sum(nil)) {
+		journal.Offset, journal.Hash = 0, nil
+		return req, nil
+	}
+
+	req.Resume.Offset, req.Digest = journal.Offset, digest
+	return req, nil
+}
+
+// receiveFile receives a single file into its part file and moves it into place once
+// the sender's trailer matches it.
+func receiveFile(ctx context.Context, readers []*FrameReader, index int, meta fileMetadata, target outputTarget, format chunkFormat, aead cipher.AEAD, chunkIndex *uint64, journal *resumeJournal) (err error) {
+	if err := os.MkdirAll(filepath.Dir(target.path), 0o755); err != nil {
+		return fmt.Errorf("could not create directory: %w", err)
+	}
+	partPath := target.partPath()
+
+	// Continue after the bytes the journal has already verified.
+	var offset int64
+	var h hash.Hash = sha256.New()
+	if journal.Offset > 0 {
+		offset = journal.Offset
+		if h, err = journal.restoreHash(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0o644)
 	if err != nil {
 		return fmt.Errorf("could not create file: %w", err)
 	}
 	defer file.Close()
 
-	bar := util.NewProgressBar(meta.Size, fmt.Sprintf("Receiving %s", meta.Name))
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("could not truncate file: %w", err)
+	}
+
+	// Whatever happens, record how far we got so a reconnect can continue from there.
+	defer func() {
+		if err != nil && file.Sync() == nil {
+			journal.checkpoint(offset, *chunkIndex, h)
+		}
+	}()
+
+	bar := util.NewProgressBar(meta.progressSize(), fmt.Sprintf("Receiving %s", meta.Name))
 	defer bar.Finish()
+	bar.Set64(offset)
+
+	// Every stream is read concurrently and its chunks are written at their offsets as
+	// soon as they are decrypted, while hashing and the journal follow in chunk order.
+	chunks := &fileChunks{readers: readers, meta: meta, format: format, aead: aead, first: *chunkIndex, start: offset}
+	openChunk := func(j *chunkJob) {
+		if chunks.open(j); j.err != nil {
+			return
+		}
+		if _, err := file.WriteAt(j.data, chunks.position(j)); err != nil {
+			j.err = fmt.Errorf("failed to write to file: %w", err)
+		}
+	}
+
+	writeChunk := func(j *chunkJob) error {
+		if err := chunks.follow(j); err != nil {
+			return err
+		}
+		*chunkIndex = j.counter + 1
+		h.Write(j.data)
+		offset += int64(len(j.data))
+		bar.Add(len(j.data))
 
-	aead, err := crypto.NewAESGCM(sharedSecret)
+		if offset-journal.Offset >= journalInterval {
+			if err := file.Sync(); err != nil {
+				return fmt.Errorf("failed to flush file: %w", err)
+			}
+			if err := journal.checkpoint(offset, *chunkIndex, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// A file the sender ended early is judged by its trailer like any other, and fails.
+	if err := newPipeline(format.size).run(ctx, chunks.first, chunks.producers(), openChunk, writeChunk); err != nil && !errors.Is(err, errEndedEarly) {
+		return err
+	}
+
+	trailer, err := chunks.trailer(index)
 	if err != nil {
-		return fmt.Errorf("could not create cipher: %w", err)
+		return err
+	}
+	// A file that doesn't match its trailer is deleted rather than resumed.
+	if err := verifyTrailer(trailer, meta, offset, h); err != nil {
+		file.Close()
+		os.Remove(partPath)
+		journal.checkpoint(0, *chunkIndex, sha256.New())
+		return fmt.Errorf("%w; the file was deleted", err)
 	}
 
-	nonce := make([]byte, aead.NonceSize())
-	var chunkIndex uint64 = 0
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to flush file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(partPath, target.path); err != nil {
+		return fmt.Errorf("could not move %s into place: %w", meta.Name, err)
+	}
+	return nil
+}
+
+// errEndedEarly is returned by a producer when the trailer arrives before all of the
+// file's chunks.
+var errEndedEarly = errors.New("the sender ended the file early")
+
+// fileChunks reads and opens the chunks that carry one file from a given offset on.
+type fileChunks struct {
+	readers []*FrameReader
+	meta    fileMetadata
+	format  chunkFormat
+	aead    cipher.AEAD
+	first   uint64 // Index of the chunk that starts at start.
+	start   int64  // Offset in the file of the first chunk.
+
+	sealedTrailer []byte // The trailer, as read after the last chunk.
+	short         bool   // A chunk shorter than the chunk size has been consumed.
+}
+
+// producers returns a producer for every stream. Each stream carries a known subset
+// of the file's chunks; a stream of unknown size comes over the control connection
+// alone, and its trailer marks where it ends. Frames are copied out of the reader's
+// buffer so they can be decrypted in place on the workers while the next ones are read.
+func (c *fileChunks) producers() []func(func(*chunkJob) bool) error {
+	bufSize := c.format.size + chunkFlagSize + c.aead.Overhead()
+	copyChunk := func(counter uint64, payload []byte) *chunkJob {
+		buf := getChunkBuffer(bufSize)
+		return &chunkJob{counter: counter, buf: buf, data: (*buf)[:copy(*buf, payload)]}
+	}
 
-	for {
-		var chunkSize uint32
-		if err := binary.Read(conn, binary.LittleEndian, &chunkSize); err != nil {
-			return fmt.Errorf("could not read chunk size: %w", err)
+	if c.meta.Stream {
+		return []func(func(*chunkJob) bool) error{func(emit func(*chunkJob) bool) error {
+			for counter := c.first; ; counter++ {
+				t, payload, err := c.readers[0].ReadFrame(msgChunk, msgTrailer)
+				if err != nil {
+					return fmt.Errorf("could not read chunk: %w", err)
+				}
+				if t == msgTrailer {
+					c.sealedTrailer = bytes.Clone(payload)
+					return nil
+				}
+				if !emit(copyChunk(counter, payload)) {
+					return nil
+				}
+			}
+		}}
+	}
+
+	// The trailer comes over the control connection, so that is where a sender that
+	// ends a file early sends it.
+	end := c.first + chunkCount(c.meta, c.start, c.format)
+	producers := make([]func(func(*chunkJob) bool) error, len(c.readers))
+	for stream, r := range c.readers {
+		want := []msgType{msgChunk}
+		if stream == 0 {
+			want = append(want, msgTrailer)
 		}
-		if chunkSize == 0 {
-			break
+		producers[stream] = func(emit func(*chunkJob) bool) error {
+			for counter := c.first; counter < end; counter++ {
+				if streamOf(counter, len(c.readers)) != stream {
+					continue
+				}
+				t, payload, err := r.ReadFrame(want...)
+				if err != nil {
+					return fmt.Errorf("could not read chunk: %w", err)
+				}
+				if t == msgTrailer {
+					c.sealedTrailer = bytes.Clone(payload)
+					return fmt.Errorf("%w: %s is missing chunk #%d", errEndedEarly, c.meta.Name, counter)
+				}
+				if !emit(copyChunk(counter, payload)) {
+					return nil
+				}
+			}
+			if stream == 0 {
+				payload, err := r.Expect(msgTrailer)
+				if err != nil {
+					return fmt.Errorf("could not read trailer for %s: %w", c.meta.Name, err)
+				}
+				c.sealedTrailer = bytes.Clone(payload)
+			}
+			return nil
 		}
+	}
+	return producers
+}
 
-		encryptedChunk := make([]byte, chunkSize)
-		if _, err := io.ReadFull(conn, encryptedChunk); err != nil {
-			return fmt.Errorf("could not read chunk: %w", err)
-		}
+// position returns where in the file a chunk belongs.
+func (c *fileChunks) position(j *chunkJob) int64 {
+	return c.start + int64(j.counter-c.first)*int64(c.format.size)
+}
 
-		binary.LittleEndian.PutUint64(nonce, chunkIndex)
-		decryptedChunk, err := aead.Open(nil, nonce, encryptedChunk, nil)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt chunk #%d (check passphrase): %w", chunkIndex, err)
+// open decrypts a chunk in place and undoes its compression. Bytes past the real size
+// are padding and are cut off.
+func (c *fileChunks) open(j *chunkJob) {
+	nonce := make([]byte, c.aead.NonceSize())
+	setChunkNonce(nonce, streamOf(j.counter, len(c.readers)), j.counter)
+	var err error
+	if j.data, err = c.aead.Open(j.data[:0], nonce, j.data, nil); err != nil {
+		j.err = fmt.Errorf("failed to decrypt chunk #%d: %w", j.counter, err)
+		return
+	}
+	if c.format.compressed {
+		if err := j.decompress(c.format.size); err != nil {
+			j.err = fmt.Errorf("chunk #%d: %w", j.counter, err)
+			return
 		}
+	}
+	if !c.meta.Stream {
+		j.data = j.data[:max(0, min(int64(len(j.data)), c.meta.Size-c.position(j)))]
+	}
+}
 
-		bytesWritten, err := file.Write(decryptedChunk)
-		if err != nil {
-			return fmt.Errorf("failed to write to file: %w", err)
-		}
-		chunkIndex++
-		bar.Add(bytesWritten)
+// follow is called on every chunk in order. Chunks are placed by their index, so only
+// the last chunk of a stream may be short.
+func (c *fileChunks) follow(j *chunkJob) error {
+	if !c.meta.Stream {
+		return nil
+	}
+	if c.short {
+		return fmt.Errorf("chunk #%d follows a short chunk in %s", j.counter, c.meta.Name)
+	}
+	c.short = len(j.data) < c.format.size
+	return nil
+}
+
+// trailer authenticates the trailer read after the file's last chunk.
+func (c *fileChunks) trailer(index int) (fileTrailer, error) {
+	var trailer fileTrailer
+	if err := openSealed(c.aead, msgTrailer, uint64(index), c.sealedTrailer, &trailer); err != nil {
+		return fileTrailer{}, fmt.Errorf("could not read trailer for %s: %w", c.meta.Name, err)
+	}
+	return trailer, nil
+}
+
+// verifyTrailer checks a file's trailer against the bytes actually received. The size
+// of a stream is only announced in its trailer.
+func verifyTrailer(trailer fileTrailer, meta fileMetadata, offset int64, h hash.Hash) error {
+	size := meta.Size
+	if meta.Stream {
+		size = trailer.Size
+	}
+	if trailer.Size != offset || trailer.Size != size || !hmac.Equal(trailer.Digest, h.Sum(nil)) {
+		return fmt.Errorf("integrity check failed for %s (got %d of %d bytes)", meta.Name, offset, size)
 	}
 	return nil
 }
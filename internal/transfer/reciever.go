@@ -1,102 +1,177 @@
 package transfer
 
 import (
-	"crypto/rand"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sumanthd032/lancrypt/internal/discovery"
+	"github.com/sumanthd032/lancrypt/internal/rendezvous"
 	"github.com/sumanthd032/lancrypt/pkg/crypto"
-	"golang.org/x/crypto/curve25519"
+	"github.com/sumanthd032/lancrypt/pkg/util"
 )
 
 type Receiver struct {
-	Code         string
-	Passphrase   string
-	privateKey   [32]byte
-	publicKey    [32]byte
-	sharedSecret *[32]byte
+	Code           string
+	Passphrase     string
+	OutDir         string              // Directory received files are written to.
+	OnConflict     ConflictPolicy      // What to do when an incoming file already exists.
+	AutoAccept     bool                // Download every file without asking first.
+	Argon2         crypto.Argon2Params // Minimum Argon2id cost for stretching the passphrase.
+	Argon2Limit    crypto.Argon2Params // Highest Argon2id cost the sender may ask for.
+	ChunkSize      int                 // Largest chunk size to accept from the sender.
+	Stdout         bool                // Write the received file to standard output.
+	SaveText       bool                // Save a text snippet as a file instead of printing it.
+	Host           string              // Sender's address; skips mDNS discovery when set.
+	Port           int                 // Sender's data port; with Host, skips the rendezvous lookup too.
+	RendezvousPort int                 // Sender's rendezvous port, for a Host given without a Port.
+	BrowseTimeout  time.Duration       // How long to look for the sender over mDNS.
+	secret         string              // Secret code suffix; when set, the PAKE replaces the SAS check.
 }
 
 func NewReceiver(code, passphrase string) (*Receiver, error) {
-	// ... (This function remains the same as Step 9)
-	var privateKey [32]byte
-	if _, err := rand.Read(privateKey[:]); err != nil {
-		return nil, fmt.Errorf("could not generate private key: %w", err)
-	}
-
-	var publicKey [32]byte
-	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+	// A code with a secret suffix came from a sender in PAKE mode. Only the public
+	// part is looked up on the network.
+	public, secret := util.SplitCode(code)
 
 	r := &Receiver{
-		Code:       code,
-		Passphrase: passphrase,
-		privateKey: privateKey,
-		publicKey:  publicKey,
+		Code:           public,
+		secret:         secret,
+		Passphrase:     passphrase,
+		OutDir:         ".",
+		OnConflict:     ConflictRename,
+		Argon2:         crypto.DefaultArgon2Params,
+		Argon2Limit:    crypto.DefaultArgon2Limit,
+		ChunkSize:      DefaultChunkSize,
+		RendezvousPort: rendezvous.DefaultPort,
+		BrowseTimeout:  discovery.DefaultBrowseTimeout,
 	}
 
 	return r, nil
 }
 
-func (r *Receiver) Connect() error {
-	fmt.Printf("🔎 Searching for sender '%s' on the local network...\n", r.Code)
-	entry, err := discovery.DiscoverService(r.Code)
-	if err != nil {
-		return err
+// locate finds the addresses the sender may be reached at and its data port. Without
+// a host, the sender is discovered over mDNS; without a port, the code is looked up on
+// the sender's rendezvous server.
+func (r *Receiver) locate(ctx context.Context) (hosts []string, port string, err error) {
+	if r.Host != "" && r.Port != 0 {
+		return []string{r.Host}, strconv.Itoa(r.Port), nil
 	}
-	host := entry.AddrIPv4[0].String()
-	fmt.Printf("✅ Found sender at %s\n", host)
 
-	rendezvousURL := fmt.Sprintf("http://%s:%d/%s", host, entry.Port, r.Code)
-	resp, err := http.Get(rendezvousURL)
-	if err != nil {
-		return fmt.Errorf("could not contact rendezvous server: %w", err)
+	hosts, rendezvousPort := []string{r.Host}, strconv.Itoa(r.RendezvousPort)
+	if r.Host == "" {
+		fmt.Fprintf(os.Stderr, "🔎 Searching for sender '%s' on the local network...\n", r.Code)
+		browseCtx, cancel := context.WithTimeout(ctx, r.BrowseTimeout)
+		entry, err := discovery.DiscoverServiceContext(browseCtx, r.Code)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			return nil, "", fmt.Errorf("%w; if multicast is blocked, use --host with an address the sender printed", err)
+		}
+		hosts, rendezvousPort = discovery.Candidates(entry), strconv.Itoa(entry.Port)
+		fmt.Fprintf(os.Stderr, "✅ Found sender at %s\n", strings.Join(hosts, ", "))
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("rendezvous server returned an error (code not found or server issue)")
+	// Any address that answers will do, so they are all asked in turn.
+	client := &http.Client{Timeout: attemptTimeout}
+	lookup := func(ctx context.Context, i int) (string, error) {
+		rendezvousURL := url.URL{Scheme: "http", Host: net.JoinHostPort(hosts[i], rendezvousPort), Path: "/" + r.Code}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rendezvousURL.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("could not contact rendezvous server: %w", err)
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusTooManyRequests:
+			return "", fmt.Errorf("rendezvous server refused the lookup: too many attempts from this address, try again later")
+		default:
+			return "", fmt.Errorf("rendezvous server returned an error (code not found or already used)")
+		}
+
+		portBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("could not read port from rendezvous response: %w", err)
+		}
+		return string(portBytes), nil
 	}
-
-	portBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("could not read port from rendezvous response: %w", err)
+	if port, err = raceAttempts(ctx, len(hosts), lookup, func(string) {}); err != nil {
+		return nil, "", err
 	}
-	port := string(portBytes)
-	targetAddr := net.JoinHostPort(host, port)
-	fmt.Printf("✅ Code resolved. Connecting to sender at %s\n", targetAddr)
+	fmt.Fprintln(os.Stderr, "✅ Code resolved.")
+	return hosts, port, nil
+}
 
-	conn, err := net.Dial("tcp", targetAddr)
-	if err != nil {
-		return fmt.Errorf("could not connect to sender: %w", err)
-	}
-	defer conn.Close()
-	fmt.Printf("✅ Connected to sender: %s\n", conn.RemoteAddr())
+// Connect finds the sender and receives its files.
+func (r *Receiver) Connect() error {
+	return r.ConnectContext(context.Background())
+}
 
-	initialSecret, err := crypto.PerformKeyExchange(conn, &r.privateKey, &r.publicKey)
+// ConnectContext is like Connect, but stops once ctx is done. A cancelled transfer is
+// not resumed: the sender is told, and the partial files are deleted.
+func (r *Receiver) ConnectContext(ctx context.Context) error {
+	hosts, port, err := r.locate(ctx)
 	if err != nil {
-		return fmt.Errorf("key exchange failed: %w", err)
+		return err
+	}
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, port)
 	}
 
-	finalSecret, err := crypto.DeriveKey(initialSecret, r.Passphrase)
+	params := handshakeParams{initiator: true, code: r.Code, passphrase: r.Passphrase, argon2: r.Argon2, argon2Limit: r.Argon2Limit, chunkSize: r.ChunkSize}
+	if r.secret != "" {
+		params.pakePassword = r.Code + "-" + r.secret
+	}
+	conn, peer, err := dialSender(ctx, addrs, params)
 	if err != nil {
-		return fmt.Errorf("key derivation failed: %w", err)
+		return err
 	}
-	r.sharedSecret = finalSecret
-	fmt.Printf("✅ Key exchange successful.\n")
+	defer conn.Close()
+	defer interruptReads(ctx, conn)()
+	fmt.Fprintf(os.Stderr, "✅ Connected to sender: %s\n", conn.RemoteAddr())
 
-	sas := crypto.GenerateSAS(r.sharedSecret, 3)
-	if err := promptForConfirmation(sas); err != nil {
+	sess, err := performHandshake(conn, params, peer)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
+	fmt.Fprintf(os.Stderr, "✅ Key exchange successful.\n")
+
+	if r.secret == "" {
+		if err := promptForConfirmation(ctx, sess.sas); err != nil {
+			if ctx.Err() != nil {
+				abortSession(conn, sess)
+			}
+			return err
+		}
+	}
 
-	if err := receiveFile(conn, r.sharedSecret); err != nil {
+	cfg := receiveConfig{Code: r.Code, OutDir: r.OutDir, Policy: r.OnConflict, AutoAccept: r.AutoAccept, Stdout: r.Stdout, SaveText: r.SaveText}
+	if err := receiveFiles(ctx, conn, cfg, sess); err != nil {
+		if _, statErr := os.Stat(journalPath(r.OutDir, r.Code)); statErr == nil && !r.Stdout {
+			fmt.Fprintln(os.Stderr, "💾 Progress saved. Run the same command again to resume the transfer.")
+		}
 		return fmt.Errorf("file transfer failed: %w", err)
 	}
 
-	fmt.Println("✅ File transfer complete.")
-	fmt.Println("Session finished.")
+	fmt.Fprintln(os.Stderr, "✅ File transfer complete.")
+	fmt.Fprintln(os.Stderr, "Session finished.")
 	return nil
 }
@@ -1,124 +1,447 @@
 package transfer
 
 import (
-	"crypto/rand"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/sumanthd032/lancrypt/internal/daemon"
 	"github.com/sumanthd032/lancrypt/internal/discovery"
 	"github.com/sumanthd032/lancrypt/internal/rendezvous"
 	"github.com/sumanthd032/lancrypt/pkg/crypto"
 	"github.com/sumanthd032/lancrypt/pkg/util"
-	"golang.org/x/crypto/curve25519"
 )
 
+// codeWords is the number of words in a transfer code: 32 bits, since every word
+// is drawn from 256.
+const codeWords = 4
+
+// pakeSecretDigits is the length of the secret code suffix used in PAKE mode.
+const pakeSecretDigits = 6
+
+// maxPAKEFailures is how many failed PAKE handshakes the sender puts up with before it
+// gives up on the code. Each one is a single online guess at the secret suffix.
+const maxPAKEFailures = 5
+
+// errNoHello is returned by serve for a connection that failed before the hellos were
+// swapped. Receivers race several addresses and drop the connections that lose, and
+// anyone on the network can open one, so these don't end the session.
+var errNoHello = errors.New("connection failed before the hello exchange")
+
+// errStalled is returned by serve for a connection whose peer stopped answering before
+// the keys were confirmed. Such a peer has proven nothing, so it doesn't end the
+// session either.
+var errStalled = errors.New("peer stopped answering during the handshake")
+
+// errPAKEFailed is returned by serve in PAKE mode for a handshake that failed before the
+// peer proved it knows the code. Anyone who saw the public part of the code can cause
+// one, so a few of them are tolerated.
+var errPAKEFailed = errors.New("password-authenticated handshake failed")
+
 type Sender struct {
-	FilePath     string
-	Passphrase   string
-	privateKey   [32]byte
-	publicKey    [32]byte
-	sharedSecret *[32]byte
-	listener     net.Listener
+	Paths          []string
+	Passphrase     string
+	Pad            bool                // Pad file streams so exact sizes don't leak to observers.
+	PAKE           bool                // Authenticate with a secret code suffix instead of a SAS check.
+	Argon2         crypto.Argon2Params // Minimum Argon2id cost for stretching the passphrase.
+	Argon2Limit    crypto.Argon2Params // Highest Argon2id cost the receiver may ask for.
+	ChunkSize      int                 // Largest chunk size to propose to the receiver.
+	Streams        int                 // Data connections to spread chunks over.
+	Compress       CompressionMode     // Whether to compress file data before encrypting it.
+	RendezvousPort int                 // Port for the rendezvous server; 0 picks a free one.
+	DaemonSocket   string              // Socket of a local daemon to register the code with, if one runs.
+	TTL            time.Duration       // How long to wait for a receiver before the code expires; 0 waits forever.
+	stdin          bool                // Data comes from standard input, so prompts use the terminal.
+	code           string              // Public transfer code, as advertised on the network.
+	password       string              // Full code used as the PAKE password.
+	listener       net.Listener
+	files          []sourceFile
 }
 
-func NewSender(filePath, passphrase string) (*Sender, error) {
-	fileInfo, err := os.Stat(filePath)
+// NewSender prepares a transfer of one or more files, directories or glob patterns,
+// all of which are sent over a single session.
+func NewSender(paths []string, passphrase string) (*Sender, error) {
+	files, err := collectSources(paths)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("file not found: %s", filePath)
-		}
-		return nil, fmt.Errorf("could not access file: %w", err)
+		return nil, err
 	}
 
-	if fileInfo.IsDir() {
-		return nil, fmt.Errorf("path is a directory, not a file: %s", filePath)
+	s, err := newSender(files, passphrase)
+	if err != nil {
+		return nil, err
 	}
+	s.Paths = paths
+	s.stdin = streaming(files)
+	return s, nil
+}
 
-	var privateKey [32]byte
-	if _, err := rand.Read(privateKey[:]); err != nil {
-		return nil, fmt.Errorf("could not generate private key: %w", err)
+// NewTextSender prepares a transfer of a text snippet, held in memory so it never
+// touches the disk. With text set to "-" the snippet is read from standard input.
+func NewTextSender(text, passphrase string) (*Sender, error) {
+	file, err := textSource(text)
+	if err != nil {
+		return nil, err
 	}
 
-	var publicKey [32]byte
-	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+	s, err := newSender([]sourceFile{file}, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.stdin = text == stdinPath
+	return s, nil
+}
 
+// newSender starts listening for the receiver of files.
+func newSender(files []sourceFile, passphrase string) (*Sender, error) {
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
 		return nil, fmt.Errorf("could not start listener: %w", err)
 	}
 
 	s := &Sender{
-		FilePath:   filePath,
-		Passphrase: passphrase,
-		privateKey: privateKey,
-		publicKey:  publicKey,
-		listener:   listener,
+		Passphrase:     passphrase,
+		Argon2:         crypto.DefaultArgon2Params,
+		Argon2Limit:    crypto.DefaultArgon2Limit,
+		ChunkSize:      DefaultChunkSize,
+		Streams:        1,
+		Compress:       CompressAuto,
+		RendezvousPort: rendezvous.DefaultPort,
+		DaemonSocket:   daemon.DefaultSocketPath(),
+		listener:       listener,
+		files:          files,
 	}
 
 	return s, nil
 }
 
+// Start announces the code and serves receivers until the files have been sent.
 func (s *Sender) Start() error {
-	rvServer := rendezvous.NewServer()
-	rvServer.Start()
-	defer rvServer.Stop()
+	return s.StartContext(context.Background())
+}
 
+// StartContext is like Start, but stops once ctx is done. A receiver that is connected
+// by then is told the transfer was cancelled, so it doesn't wait to resume it.
+func (s *Sender) StartContext(ctx context.Context) error {
 	addrParts := strings.Split(s.listener.Addr().String(), ":")
 	port := addrParts[len(addrParts)-1]
 
-	code, err := util.GenerateCode(3)
+	code, err := util.GenerateCode(codeWords)
 	if err != nil {
 		return fmt.Errorf("could not generate code: %w", err)
 	}
 
-	rvServer.Register(code, port)
+	s.code = code
 
-	rendezvousPort, _ := strconv.Atoi(rendezvous.RendezvousPort)
-	mdnsServer, err := discovery.PublishService(code, rendezvousPort)
-	if err != nil {
-		return fmt.Errorf("could not publish mDNS service: %w", err)
+	// In PAKE mode the full code carries a secret suffix. Only the public part is
+	// advertised; the whole code is the password for the key exchange.
+	fullCode := code
+	if s.PAKE {
+		secret, err := util.GenerateSecret(pakeSecretDigits)
+		if err != nil {
+			return fmt.Errorf("could not generate code: %w", err)
+		}
+		fullCode = code + "-" + secret
+		s.password = fullCode
 	}
-	defer mdnsServer.Shutdown()
 
-	fmt.Printf("✅ Sender is ready.\nYour transfer code is: %s\n\n", code)
-	fmt.Printf("On the other device, run: lancrypt recv --code %s\n", code)
+	// Once the TTL has passed no new connection is accepted, and a connection whose
+	// transfer hasn't started yet is cut off through stopAttempt. A transfer that is
+	// already running is left to finish, but can't be resumed any more. The deadline
+	// is set before the code is announced, so a daemon holding it can't lapse first.
+	var deadline time.Time
+	var expired atomic.Bool
+	var mu sync.Mutex
+	var stopAttempt context.CancelCauseFunc
+	expire := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		expired.Store(true)
+		s.listener.Close()
+		if stopAttempt != nil {
+			stopAttempt(ErrExpired)
+		}
+	}
+	if s.TTL > 0 {
+		deadline = time.Now().Add(s.TTL)
+		expiry := time.AfterFunc(s.TTL, expire)
+		defer expiry.Stop()
+	}
 
-	conn, err := s.listener.Accept()
+	ann, err := s.announce(code, port)
 	if err != nil {
-		return fmt.Errorf("failed to accept connection: %w", err)
+		return err
+	}
+	defer ann.withdraw()
+	// A daemon withdraws codes after its own maximum TTL, which ends the wait as well.
+	if ann.expired != nil {
+		go func() {
+			for range ann.expired {
+				expire()
+			}
+		}()
+	}
+
+	// interrupted is the last failure of a transfer that had started. Once the code
+	// expires, that failure is what ends the session, not the expiry: a receiver did
+	// connect in time.
+	var interrupted error
+	expiredErr := func() error {
+		if interrupted != nil {
+			return fmt.Errorf("%w; the code has expired, so it can no longer be resumed", interrupted)
+		}
+		return ErrExpired
+	}
+	rearm := func() error {
+		if expired.Load() {
+			return expiredErr()
+		}
+		return ann.renew()
+	}
+
+	stopAccepting := context.AfterFunc(ctx, func() { s.listener.Close() })
+	defer stopAccepting()
+
+	fmt.Fprintf(os.Stderr, "✅ Sender is ready.\nYour transfer code is: %s\n\n", fullCode)
+	fmt.Fprintf(os.Stderr, "On the other device, run: lancrypt recv --code %s\n", fullCode)
+	s.printAddresses(fullCode, port)
+
+	// Keep accepting connections until a transfer completes: once the receiver has
+	// accepted a transfer, a dropped connection can be resumed with the same code.
+	pakeFailures := 0
+	for {
+		stopCountdown := func() {}
+		if !deadline.IsZero() {
+			stopCountdown = countdown(deadline)
+		}
+		conn, err := s.listener.Accept()
+		stopCountdown()
+		if err != nil {
+			if expired.Load() {
+				return expiredErr()
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		// Whoever looked the code up has connected, so it isn't handed out again.
+		ann.consume()
+
+		attempt, stop := context.WithCancelCause(ctx)
+		mu.Lock()
+		stopAttempt = stop
+		if expired.Load() {
+			stop(ErrExpired)
+		}
+		mu.Unlock()
+		started, err := s.serve(attempt, conn, func() {
+			mu.Lock()
+			stopAttempt = nil
+			mu.Unlock()
+		})
+		conn.Close()
+		stop(nil)
+		if err == nil {
+			break
+		}
+		if errors.Is(context.Cause(attempt), ErrExpired) {
+			return expiredErr()
+		}
+		if errors.Is(err, errPAKEFailed) {
+			pakeFailures++
+			if pakeFailures >= maxPAKEFailures {
+				return fmt.Errorf("giving up after %d failed attempts: %w", pakeFailures, err)
+			}
+			fmt.Fprintf(os.Stderr, "⚠️  %v (%d more failed attempts are allowed)\n", err, maxPAKEFailures-pakeFailures)
+		}
+		if errors.Is(err, errNoHello) || errors.Is(err, errStalled) || errors.Is(err, errPAKEFailed) {
+			// Whoever looked up the code used it up; let the real receiver find us.
+			if err := rearm(); err != nil {
+				return err
+			}
+			continue
+		}
+		// Whatever was read from standard input is gone, so a pipe can't be resumed,
+		// and neither can a transfer that either side cancelled.
+		if !started || streaming(s.files) || ctx.Err() != nil || errors.Is(err, errPeerAborted) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\n⚠️  %v\n", err)
+		interrupted = err
+		if err := rearm(); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Waiting for the receiver to reconnect with the same code to resume...")
 	}
-	defer conn.Close()
-	s.listener.Close()
 
-	fmt.Printf("\n🤝 Peer connected from: %s\n", conn.RemoteAddr())
+	fmt.Fprintln(os.Stderr, "✅ File transfer complete.")
+	fmt.Fprintln(os.Stderr, "Session finished.")
+	return nil
+}
+
+// announcement controls a code that is resolvable on the network. The rendezvous
+// server hands the port out only once: consume keeps it that way when a connection
+// comes in, and renew makes the code resolvable again before waiting for another one.
+// withdraw takes the code off the network. expired, if set, delivers the code when
+// whatever announces it has given up on it.
+type announcement struct {
+	renew    func() error
+	consume  func()
+	withdraw func()
+	expired  <-chan string
+}
+
+// announce makes the code resolvable on the network, through the local daemon when
+// one is running and with a rendezvous server and mDNS service of our own otherwise.
+func (s *Sender) announce(code, port string) (announcement, error) {
+	if client, err := daemon.Dial(s.DaemonSocket); err == nil {
+		if err := client.Register(code, port, s.TTL); err != nil {
+			client.Close()
+			return announcement{}, err
+		}
+		fmt.Fprintln(os.Stderr, "✅ Registered with the local lancrypt daemon.")
+		return announcement{
+			renew:   func() error { return client.Register(code, port, s.TTL) },
+			consume: func() { client.Consume(code) },
+			withdraw: func() {
+				client.Deregister(code)
+				client.Close()
+			},
+			expired: client.Expired(),
+		}, nil
+	}
 
-	initialSecret, err := crypto.PerformKeyExchange(conn, &s.privateKey, &s.publicKey)
+	rvServer, err := s.startRendezvous()
+	if err != nil {
+		return announcement{}, err
+	}
+	rvServer.Register(code, port)
+	mdnsServer, err := discovery.PublishService(code, rvServer.Port())
 	if err != nil {
-		return fmt.Errorf("key exchange failed: %w", err)
+		rvServer.Stop()
+		return announcement{}, fmt.Errorf("could not publish mDNS service: %w", err)
 	}
+	return announcement{
+		renew: func() error {
+			rvServer.Register(code, port)
+			return nil
+		},
+		consume: func() { rvServer.Consume(code) },
+		withdraw: func() {
+			mdnsServer.Shutdown()
+			rvServer.Stop()
+		},
+	}, nil
+}
 
-	finalSecret, err := crypto.DeriveKey(initialSecret, s.Passphrase)
+// startRendezvous starts the rendezvous server. The default port may well be taken by
+// another sender on this machine; since receivers learn the real port over mDNS, a
+// free one is used instead. A port that was asked for explicitly has to be available.
+func (s *Sender) startRendezvous() (*rendezvous.Server, error) {
+	rvServer := rendezvous.NewServer(s.RendezvousPort)
+	err := rvServer.Start()
+	if err != nil && s.RendezvousPort == rendezvous.DefaultPort {
+		fmt.Fprintf(os.Stderr, "⚠️  Rendezvous port %d is in use, picking a free one\n", rendezvous.DefaultPort)
+		rvServer = rendezvous.NewServer(0)
+		err = rvServer.Start()
+	}
 	if err != nil {
-		return fmt.Errorf("key derivation failed: %w", err)
+		return nil, err
 	}
-	s.sharedSecret = finalSecret
-	fmt.Printf("✅ Key exchange successful.\n")
+	return rvServer, nil
+}
 
-	sas := crypto.GenerateSAS(s.sharedSecret, 3)
-	if err := promptForConfirmation(sas); err != nil {
-		return err
+// printAddresses lists the commands that reach this sender without mDNS, for
+// networks that filter multicast.
+func (s *Sender) printAddresses(code, port string) {
+	ips, err := discovery.LocalAddresses()
+	if err != nil || len(ips) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "\nIf the sender can't be discovered, connect directly with one of:")
+	for _, ip := range ips {
+		fmt.Fprintf(os.Stderr, "    lancrypt recv --code %s --host %s --port %s\n", code, ip, port)
 	}
+}
 
-	if err := sendFile(conn, s.FilePath, s.sharedSecret); err != nil {
-		return fmt.Errorf("file transfer failed: %w", err)
+// serve runs the handshake and transfer over one connection. Each handshake uses
+// fresh ephemeral keys, so a resumed transfer never shares keys with the old one.
+// onStart is called once the receiver has accepted the transfer.
+func (s *Sender) serve(ctx context.Context, conn net.Conn, onStart func()) (started bool, err error) {
+	params := handshakeParams{
+		code:         s.code,
+		passphrase:   s.Passphrase,
+		argon2:       s.Argon2,
+		argon2Limit:  s.Argon2Limit,
+		pakePassword: s.password,
+		chunkSize:    s.ChunkSize,
+		timeout:      attemptTimeout,
+	}
+	defer interruptReads(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(attemptTimeout))
+	peer, err := exchangeHello(conn, params.auth(), params.chunkSize)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		fmt.Fprintf(os.Stderr, "⚠️  Ignoring connection from %s: %v\n", conn.RemoteAddr(), err)
+		return false, errNoHello
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
 	}
+	fmt.Fprintf(os.Stderr, "\n🤝 Peer connected from: %s\n", conn.RemoteAddr())
 
-	fmt.Println("✅ File transfer complete.")
-	fmt.Println("Session finished.")
-	return nil
+	// The code is public, so a peer that goes quiet before proving anything must not
+	// hold up the real receiver: every step of the handshake keeps a deadline.
+	sess, err := performHandshake(conn, params, peer)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "⚠️  Ignoring connection from %s: %v\n", conn.RemoteAddr(), err)
+			return false, errStalled
+		}
+		if s.PAKE {
+			return false, fmt.Errorf("%w with %s: %w", errPAKEFailed, conn.RemoteAddr(), err)
+		}
+		return false, err
+	}
+	// Clearing the deadline would undo an interruption that came in meanwhile.
+	conn.SetDeadline(time.Time{})
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	fmt.Fprintf(os.Stderr, "✅ Key exchange successful.\n")
+
+	// The PAKE already proves the peer knows the secret code, so there is nothing
+	// left for the users to compare.
+	if !s.PAKE {
+		if s.stdin {
+			if err := useTerminal(); err != nil {
+				return false, err
+			}
+		}
+		if err := promptForConfirmation(ctx, sess.sas); err != nil {
+			if ctx.Err() != nil {
+				abortSession(conn, sess)
+			}
+			return false, err
+		}
+	}
+
+	started, err = sendFiles(ctx, conn, s.files, sess, sendConfig{Pad: s.Pad, Streams: s.Streams, Compress: s.Compress, Started: onStart})
+	if err != nil {
+		return started, fmt.Errorf("file transfer failed: %w", err)
+	}
+	return true, nil
 }
 
 func (s *Sender) Close() {
@@ -0,0 +1,131 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sumanthd032/lancrypt/pkg/crypto"
+)
+
+// fakeDaemon accepts every request on a temporary socket, so a sender can announce its
+// code without multicast.
+func fakeDaemon(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					conn.Write([]byte("{}\n"))
+				}
+			}()
+		}
+	}()
+	return path
+}
+
+// startSender runs a text sender, set up by setup, until it returns.
+func startSender(t *testing.T, setup func(*Sender)) (*Sender, <-chan error) {
+	t.Helper()
+	s, err := NewTextSender("hello", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	s.DaemonSocket = fakeDaemon(t)
+	setup(s)
+
+	done := make(chan error, 1)
+	go func() { done <- s.StartContext(context.Background()) }()
+	return s, done
+}
+
+// TestExpiryCutsOffStalledHandshake checks that a peer which says hello and then goes
+// quiet can't keep an expiring code alive.
+func TestExpiryCutsOffStalledHandshake(t *testing.T) {
+	silenceOutput(t)
+	s, done := startSender(t, func(s *Sender) { s.TTL = time.Second })
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := exchangeHello(conn, authSAS, DefaultChunkSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// Well within attemptTimeout, so only the expiry can end the handshake.
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrExpired) {
+			t.Fatalf("StartContext returned %v, want %v", err, ErrExpired)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartContext still running 4s after the code expired")
+	}
+}
+
+// TestSenderToleratesWrongCodes checks that in PAKE mode a peer guessing the secret
+// code can't end the transfer with one wrong guess, but that the sender does give up
+// after several.
+func TestSenderToleratesWrongCodes(t *testing.T) {
+	silenceOutput(t)
+	s, done := startSender(t, func(s *Sender) { s.PAKE = true })
+
+	guess := handshakeParams{
+		initiator:    true,
+		code:         "wrong-guess",
+		argon2:       crypto.DefaultArgon2Params,
+		argon2Limit:  crypto.DefaultArgon2Limit,
+		pakePassword: "wrong-guess-000000",
+		chunkSize:    DefaultChunkSize,
+	}
+	for i := 1; i <= maxPAKEFailures; i++ {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		peer, err := exchangeHello(conn, authPAKE, DefaultChunkSize)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		if _, err := performHandshake(conn, guess, peer); !errors.Is(err, crypto.ErrKeyMismatch) {
+			t.Fatalf("attempt %d: handshake = %v, want %v", i, err, crypto.ErrKeyMismatch)
+		}
+		conn.Close()
+
+		if i < maxPAKEFailures {
+			select {
+			case err := <-done:
+				t.Fatalf("sender gave up after %d wrong guesses: %v", i, err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errPAKEFailed) {
+			t.Fatalf("StartContext returned %v, want %v", err, errPAKEFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sender still running after %d wrong guesses", maxPAKEFailures)
+	}
+}
@@ -0,0 +1,116 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MaxStreams bounds the number of data connections a session may use.
+const MaxStreams = 16
+
+// streamTimeout is how long the receiver waits for the sender's extra connections.
+const streamTimeout = 10 * time.Second
+
+// streamHello opens every extra data connection. It is sealed under the session key
+// with the stream number as its counter, which ties the connection to the session
+// that was already authenticated.
+type streamHello struct {
+	Stream int `json:"stream"`
+}
+
+// setChunkNonce fills nonce for a chunk. The stream number sits between the counter
+// and the message type, so a chunk can't be moved onto another connection.
+func setChunkNonce(nonce []byte, stream int, counter uint64) {
+	setNonce(nonce, msgChunk, counter)
+	binary.LittleEndian.PutUint16(nonce[8:], uint16(stream))
+}
+
+// streamOf returns the stream a chunk travels on.
+func streamOf(counter uint64, streams int) int {
+	return int(counter % uint64(streams))
+}
+
+// openStreams dials the receiver's stream listener once for every stream after the
+// first, which is the control connection itself.
+func openStreams(conn net.Conn, port, streams int, aead cipher.AEAD) ([]net.Conn, error) {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	var conns []net.Conn
+	for i := 1; i < streams; i++ {
+		c, err := net.DialTimeout("tcp", addr, streamTimeout)
+		if err != nil {
+			closeAll(conns)
+			return nil, fmt.Errorf("could not open data stream %d: %w", i, err)
+		}
+		conns = append(conns, c)
+		if err := writeSealed(NewFrameWriter(c), aead, msgStream, uint64(i), streamHello{Stream: i}); err != nil {
+			closeAll(conns)
+			return nil, fmt.Errorf("could not open data stream %d: %w", i, err)
+		}
+	}
+	return conns, nil
+}
+
+// acceptStreams waits for the sender's extra connections and puts them in stream
+// order. A connection that can't prove it belongs to the session is dropped.
+func acceptStreams(listener *net.TCPListener, streams int, aead cipher.AEAD) ([]net.Conn, error) {
+	listener.SetDeadline(time.Now().Add(streamTimeout))
+	conns := make([]net.Conn, streams-1)
+	for accepted := 0; accepted < streams-1; {
+		c, err := listener.Accept()
+		if err != nil {
+			closeAll(conns)
+			return nil, fmt.Errorf("sender did not open its data streams: %w", err)
+		}
+
+		c.SetReadDeadline(time.Now().Add(streamTimeout))
+		id, err := identifyStream(c, conns, aead)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  Rejected data stream from %s: %v\n", c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+		c.SetReadDeadline(time.Time{})
+		conns[id-1] = c
+		accepted++
+	}
+	return conns, nil
+}
+
+// identifyStream reads the stream hello of a new connection. The stream number is
+// not sent in the clear, so every stream still missing is tried in turn.
+func identifyStream(c net.Conn, conns []net.Conn, aead cipher.AEAD) (int, error) {
+	sealed, err := NewFrameReader(c).Expect(msgStream)
+	if err != nil {
+		return 0, err
+	}
+	for i, existing := range conns {
+		var hello streamHello
+		if existing != nil || openSealed(aead, msgStream, uint64(i+1), sealed, &hello) != nil {
+			continue
+		}
+		if hello.Stream != i+1 {
+			return 0, fmt.Errorf("stream number mismatch")
+		}
+		return hello.Stream, nil
+	}
+	return 0, fmt.Errorf("could not authenticate stream")
+}
+
+// closeAll closes every connection in conns.
+func closeAll(conns []net.Conn) {
+	for _, c := range conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/sumanthd032/lancrypt/pkg/util"
+)
+
+// MaxTextSize bounds a text snippet. The receiver holds the whole snippet in memory
+// until its trailer has been checked, so anything larger should be sent as a file.
+const MaxTextSize = 1024 * 1024
+
+// textName is the name a text snippet is saved under when the receiver asks for a file.
+const textName = "message.txt"
+
+// textSource returns the entry for a text snippet. With text set to "-" the snippet is
+// read from standard input.
+func textSource(text string) (sourceFile, error) {
+	data := []byte(text)
+	if text == stdinPath {
+		var err error
+		if data, err = io.ReadAll(io.LimitReader(os.Stdin, MaxTextSize+1)); err != nil {
+			return sourceFile{}, fmt.Errorf("could not read text: %w", err)
+		}
+	}
+	if len(data) == 0 {
+		return sourceFile{}, fmt.Errorf("no text to send")
+	}
+	if len(data) > MaxTextSize {
+		return sourceFile{}, fmt.Errorf("text is larger than %s, send it as a file instead", util.FormatBytes(MaxTextSize))
+	}
+	return sourceFile{meta: fileMetadata{Name: textName, Size: int64(len(data)), Text: true}, text: data}, nil
+}
+
+// printText shows a received text snippet on standard output. Control characters
+// other than line breaks and tabs are replaced, so the sender can't drive the
+// terminal with escape sequences.
+func printText(text []byte) {
+	s := strings.ReplaceAll(strings.ToValidUTF8(string(text), string(unicode.ReplacementChar)), "\r\n", "\n")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return unicode.ReplacementChar
+		}
+		return r
+	}, s)
+
+	fmt.Fprintln(os.Stderr, "📋 Received text:")
+	fmt.Print(s)
+	if !strings.HasSuffix(s, "\n") {
+		fmt.Println()
+	}
+}
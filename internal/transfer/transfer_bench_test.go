@@ -0,0 +1,130 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sumanthd032/lancrypt/pkg/crypto"
+)
+
+// benchFileSize is the size of the file sent in each benchmark iteration.
+const benchFileSize = 64 * 1024 * 1024
+
+// BenchmarkTransfer sends a file over loopback TCP at several chunk sizes. Run it with
+// `go test -bench Transfer ./internal/transfer` to get the throughput in MB/s.
+func BenchmarkTransfer(b *testing.B) {
+	src := filepath.Join(b.TempDir(), "payload.bin")
+	data := make([]byte, benchFileSize)
+	rand.Read(data)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+	files, err := collectSources([]string{src})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{MinChunkSize, 256 * 1024, DefaultChunkSize, MaxChunkSize} {
+		b.Run(fmt.Sprintf("chunk=%dKiB", size/1024), func(b *testing.B) {
+			silenceOutput(b)
+			b.SetBytes(benchFileSize)
+			for b.Loop() {
+				transferOnce(b, files, size, sendConfig{Streams: 1, Compress: CompressNone})
+			}
+		})
+	}
+	for _, streams := range []int{2, 4} {
+		b.Run(fmt.Sprintf("streams=%d", streams), func(b *testing.B) {
+			silenceOutput(b)
+			b.SetBytes(benchFileSize)
+			for b.Loop() {
+				transferOnce(b, files, DefaultChunkSize, sendConfig{Streams: streams, Compress: CompressNone})
+			}
+		})
+	}
+	// Random data doesn't shrink, so this measures the cost of trying, with every chunk
+	// carrying its compression flag.
+	b.Run(fmt.Sprintf("chunk=%dKiB/compress=auto", MaxChunkSize/1024), func(b *testing.B) {
+		silenceOutput(b)
+		b.SetBytes(benchFileSize)
+		for b.Loop() {
+			transferOnce(b, files, MaxChunkSize, sendConfig{Streams: 1, Compress: CompressAuto})
+		}
+	})
+}
+
+// transferOnce runs one sender and receiver pair over a fresh loopback connection and
+// returns the directory the files were received into.
+func transferOnce(b testing.TB, files []sourceFile, chunkSize int, send sendConfig) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	sendSess, recvSess := testSessions(b, chunkSize)
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		_, err = sendFiles(b.Context(), conn, files, sendSess, send)
+		errs <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	cfg := receiveConfig{Code: "bench", OutDir: b.TempDir(), Policy: ConflictOverwrite, AutoAccept: true}
+	if err := receiveFiles(b.Context(), conn, cfg, recvSess); err != nil {
+		b.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		b.Fatal(err)
+	}
+	return cfg.OutDir
+}
+
+// testSessions builds a matching pair of sessions without running the handshake.
+func testSessions(b testing.TB, chunkSize int) (sender, receiver *session) {
+	var s2r, r2s [crypto.KeySize]byte
+	rand.Read(s2r[:])
+	rand.Read(r2s[:])
+
+	newAEAD := func(key *[crypto.KeySize]byte) cipher.AEAD {
+		aead, err := crypto.NewAESGCM(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return aead
+	}
+	peer := &helloResult{version: protocolVersion, capabilities: localCapabilities, chunkSize: chunkSize}
+	sender = &session{send: newAEAD(&s2r), recv: newAEAD(&r2s), peer: peer}
+	receiver = &session{send: newAEAD(&r2s), recv: newAEAD(&s2r), peer: peer}
+	return sender, receiver
+}
+
+// silenceOutput hides the progress bars and status lines for the rest of a test.
+func silenceOutput(b testing.TB) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = devNull, devNull
+	b.Cleanup(func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		devNull.Close()
+	})
+}
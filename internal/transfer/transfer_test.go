@@ -0,0 +1,305 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTransferRoundTrip sends random and compressible files at the smallest and largest
+// chunk sizes in every compression mode and checks that they arrive intact. Random data
+// fills every chunk to the brim even with a compression flag in front.
+func TestTransferRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	random := make([]byte, 9*1024*1024+123)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("lancrypt sends files over the LAN\n"), 200_000)
+	contents := map[string][]byte{"random.bin": random, "text.txt": text}
+
+	var paths []string
+	for name, data := range contents {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	files, err := collectSources(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{MinChunkSize, MaxChunkSize} {
+		for _, mode := range []CompressionMode{CompressNone, CompressAuto, CompressZstd} {
+			t.Run(fmt.Sprintf("chunk=%dKiB/compress=%s", size/1024, mode), func(t *testing.T) {
+				silenceOutput(t)
+				out := transferOnce(t, files, size, sendConfig{Streams: 1, Compress: mode})
+				for name, want := range contents {
+					got, err := os.ReadFile(filepath.Join(out, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("%s arrived with %d bytes that differ from the %d sent", name, len(got), len(want))
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestSenderWaitsForConfirmation hangs up on the sender once the transfer has started.
+// A small file fits in the socket buffers, so every write succeeds, but the sender must
+// not take that for a completed transfer.
+func TestSenderWaitsForConfirmation(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "small.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := collectSources([]string{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	silenceOutput(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sendSess, recvSess := testSessions(t, MinChunkSize)
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		_, err = sendFiles(t.Context(), conn, files, sendSess, sendConfig{Streams: 1, Compress: CompressNone})
+		errs <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := NewFrameReader(conn), NewFrameWriter(conn)
+	var manifest transferManifest
+	if err := readSealed(r, recvSess.recv, msgManifest, 0, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSealed(w, recvSess.send, msgRequest, 0, transferRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	var resume resumePoint
+	if err := readSealed(r, recvSess.recv, msgResume, 0, &resume); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := <-errs; err == nil {
+		t.Fatal("sendFiles succeeded although the receiver hung up before the files arrived")
+	}
+}
+
+// TestReceiverRefusesUnsafeManifest offers names that would escape the output directory
+// or drive the terminal, and text that could grow without bound, and checks that the
+// receiver declines before showing or receiving any of it.
+func TestReceiverRefusesUnsafeManifest(t *testing.T) {
+	entries := []fileMetadata{
+		{Name: "\x1b[2J\x1b[31mreport.pdf", Size: 1},
+		{Name: "../escape.txt", Size: 1},
+		{Name: "dir/\x07bell", Size: 1},
+		{Name: textName, Text: true, Stream: true},
+	}
+	for _, entry := range entries {
+		t.Run(fmt.Sprintf("%q", entry.Name), func(t *testing.T) {
+			stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved := os.Stderr
+			os.Stderr = stderr
+			t.Cleanup(func() { os.Stderr = saved })
+
+			sendConn, recvConn := net.Pipe()
+			sendSess, recvSess := testSessions(t, MinChunkSize)
+			declined := make(chan bool, 1)
+			go func() {
+				defer sendConn.Close()
+				r, w := NewFrameReader(sendConn), NewFrameWriter(sendConn)
+				manifest := transferManifest{Entries: []fileMetadata{entry}}
+				var req transferRequest
+				if writeSealed(w, sendSess.send, msgManifest, 0, manifest) != nil || readSealed(r, sendSess.recv, msgRequest, 0, &req) != nil {
+					declined <- false
+					return
+				}
+				declined <- req.Decline
+			}()
+
+			cfg := receiveConfig{Code: "test", OutDir: t.TempDir(), Policy: ConflictRename, AutoAccept: true}
+			err = receiveFiles(t.Context(), recvConn, cfg, recvSess)
+			recvConn.Close()
+			if err == nil {
+				t.Fatal("receiveFiles accepted an unsafe name")
+			}
+			if !<-declined {
+				t.Error("the receiver did not decline the transfer")
+			}
+			os.Stderr = saved
+			printed, err := os.ReadFile(stderr.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.ContainsAny(printed, "\x1b\x07") {
+				t.Errorf("control characters reached the terminal: %q", printed)
+			}
+		})
+	}
+}
+
+// TestReceiverRejectsBadTrailer has a sender end a file early or describe it wrongly in
+// its trailer, and checks that the receiver fails the transfer without leaving the
+// file behind, finished or partial.
+func TestReceiverRejectsBadTrailer(t *testing.T) {
+	data := make([]byte, 3*MinChunkSize-100)
+	rand.Read(data)
+	digest := sha256.Sum256(data)
+	chunks := [][]byte{data[:MinChunkSize], data[MinChunkSize : 2*MinChunkSize], data[2*MinChunkSize:]}
+
+	tests := []struct {
+		name    string
+		stream  bool
+		chunks  [][]byte
+		trailer fileTrailer
+	}{
+		{"truncated", false, chunks[:2], fileTrailer{Size: int64(len(data)), Digest: digest[:]}},
+		{"truncated stream", true, chunks[:2], fileTrailer{Size: int64(len(data)), Digest: digest[:]}},
+		{"wrong size", false, chunks, fileTrailer{Size: int64(len(data)) + 1, Digest: digest[:]}},
+		{"wrong size of stream", true, chunks, fileTrailer{Size: int64(len(data)) - 1, Digest: digest[:]}},
+		{"wrong digest", false, chunks, fileTrailer{Size: int64(len(data)), Digest: make([]byte, sha256.Size)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			silenceOutput(t)
+			sendConn, recvConn := net.Pipe()
+			sendSess, recvSess := testSessions(t, MinChunkSize)
+			go func() {
+				defer sendConn.Close()
+				r, w := NewFrameReader(sendConn), NewFrameWriter(sendConn)
+				manifest := transferManifest{Entries: []fileMetadata{{Name: "data.bin", Size: int64(len(data)), Stream: tt.stream}}}
+				var req transferRequest
+				if writeSealed(w, sendSess.send, msgManifest, 0, manifest) != nil ||
+					readSealed(r, sendSess.recv, msgRequest, 0, &req) != nil ||
+					writeSealed(w, sendSess.send, msgResume, 0, resumePoint{}) != nil {
+					return
+				}
+				for i, chunk := range tt.chunks {
+					if writeSealedBytes(w, sendSess.send, msgChunk, uint64(i), chunk) != nil {
+						return
+					}
+				}
+				writeSealed(w, sendSess.send, msgTrailer, 0, tt.trailer)
+			}()
+
+			cfg := receiveConfig{Code: "test", OutDir: t.TempDir(), Policy: ConflictRename, AutoAccept: true}
+			err := receiveFiles(t.Context(), recvConn, cfg, recvSess)
+			recvConn.Close()
+			if err == nil || !strings.Contains(err.Error(), "integrity check failed") {
+				t.Fatalf("receiveFiles = %v, want an integrity error", err)
+			}
+			target := outputTarget{path: filepath.Join(cfg.OutDir, "data.bin")}
+			for _, path := range []string{target.path, target.partPath()} {
+				if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%s was left behind", filepath.Base(path))
+				}
+			}
+		})
+	}
+}
+
+// TestReceiverCancelAborts cancels the receiver while a file is coming in and checks
+// that the sender hears about it, and that nothing is left to resume.
+func TestReceiverCancelAborts(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"first.bin", "second.bin"} {
+		data := make([]byte, 32*1024*1024)
+		rand.Read(data)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	files, err := collectSources(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	silenceOutput(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sendSess, recvSess := testSessions(t, MinChunkSize)
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			sent <- err
+			return
+		}
+		defer conn.Close()
+		_, err = sendFiles(t.Context(), conn, files, sendSess, sendConfig{Streams: 1, Compress: CompressNone})
+		sent <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Cancel as soon as the first file has started to arrive.
+	cfg := receiveConfig{Code: "test", OutDir: t.TempDir(), Policy: ConflictRename, AutoAccept: true}
+	part := outputTarget{path: filepath.Join(cfg.OutDir, "first.bin")}.partPath()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			if info, err := os.Stat(part); err == nil && info.Size() > 0 {
+				cancel()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	defer interruptReads(ctx, conn)()
+
+	if err := receiveFiles(ctx, conn, cfg, recvSess); !errors.Is(err, context.Canceled) {
+		t.Fatalf("receiveFiles = %v, want %v", err, context.Canceled)
+	}
+	if err := <-sent; !errors.Is(err, errPeerAborted) {
+		t.Fatalf("sendFiles = %v, want %v", err, errPeerAborted)
+	}
+	left, err := os.ReadDir(cfg.OutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range left {
+		t.Errorf("%s was left behind", e.Name())
+	}
+}
@@ -7,26 +7,39 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-// DeriveKey uses HKDF to derive a strong cryptographic key from an initial shared secret and an optional passphrase.
-func DeriveKey(secret *[KeySize]byte, passphrase string) (*[KeySize]byte, error) {
+// sessionKeysLabel prefixes the HKDF info, so these keys can never collide with keys
+// derived from the same secret for another purpose.
+const sessionKeysLabel = "LanCrypt session keys v1"
+
+// SessionKeys are the keys derived from one handshake. Each direction has its own key,
+// so the two peers never seal messages under the same key and nonce.
+type SessionKeys struct {
+	SenderToReceiver [KeySize]byte
+	ReceiverToSender [KeySize]byte
+	Confirm          [KeySize]byte // Key for the key-confirmation MACs.
+	SAS              [KeySize]byte // Input for the Short Authentication String.
+}
+
+// DeriveSessionKeys uses HKDF to derive the session keys from the initial shared secret
+// and an optional passphrase key, as produced by StretchPassphrase. The transcript hash
+// is mixed into the HKDF info, which binds the keys to the roles, protocol version and
+// transfer code of this handshake.
+func DeriveSessionKeys(secret *[KeySize]byte, passphraseKey []byte, transcript []byte) (*SessionKeys, error) {
 	// HKDF is a two-step process: Extract and Expand.
-	// We use the passphrase as the "salt" which adds entropy. If no passphrase is provided, salt is nil.
-	var salt []byte
-	if passphrase != "" {
-		salt = []byte(passphrase)
-	}
+	// We use the stretched passphrase as the "salt" which adds entropy. Without a passphrase, salt is nil.
+	salt := passphraseKey
 
 	// 1. Extract: Create a pseudorandom key from the initial secret and salt.
-	// This step concentrates the entropy of the input keying material.
-	hash := sha256.New
-	extractor := hkdf.New(hash, secret[:], salt, nil)
-
-	// 2. Expand: Generate the final key of the desired length.
-	finalKey := new([KeySize]byte)
-	_, err := io.ReadFull(extractor, finalKey[:])
-	if err != nil {
-		return nil, err
+	// 2. Expand: Generate every session key, bound to the handshake transcript.
+	info := append([]byte(sessionKeysLabel), transcript...)
+	extractor := hkdf.New(sha256.New, secret[:], salt, info)
+
+	keys := new(SessionKeys)
+	for _, key := range []*[KeySize]byte{&keys.SenderToReceiver, &keys.ReceiverToSender, &keys.Confirm, &keys.SAS} {
+		if _, err := io.ReadFull(extractor, key[:]); err != nil {
+			return nil, err
+		}
 	}
 
-	return finalKey, nil
+	return keys, nil
 }
@@ -2,6 +2,7 @@
 package crypto
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io"
 	"net"
@@ -11,9 +12,22 @@ import (
 
 const KeySize = 32 // Defines the size of our keys (32 bytes / 256 bits)
 
+// GenerateKeyPair creates a fresh ephemeral X25519 key pair.
+func GenerateKeyPair() (privateKey, publicKey *[KeySize]byte, err error) {
+	privateKey = new([KeySize]byte)
+	if _, err := rand.Read(privateKey[:]); err != nil {
+		return nil, nil, fmt.Errorf("could not generate private key: %w", err)
+	}
+
+	publicKey = new([KeySize]byte)
+	curve25519.ScalarBaseMult(publicKey, privateKey)
+	return privateKey, publicKey, nil
+}
+
 // PerformKeyExchange handles the cryptographic handshake over a network connection.
 // It sends the local public key, receives the remote public key, and computes the shared secret.
-func PerformKeyExchange(conn net.Conn, localPrivateKey, localPublicKey *[KeySize]byte) (*[KeySize]byte, error) {
+// Both public keys are added to the transcript in initiator-responder order.
+func PerformKeyExchange(conn net.Conn, localPrivateKey, localPublicKey *[KeySize]byte, transcript *Transcript, initiator bool) (*[KeySize]byte, error) {
 	// --- Step 1: Send our public key ---
 	// We write our public key to the connection for the other peer to receive.
 	if _, err := conn.Write(localPublicKey[:]); err != nil {
@@ -35,6 +49,8 @@ func PerformKeyExchange(conn net.Conn, localPrivateKey, localPublicKey *[KeySize
 		return nil, fmt.Errorf("could not compute shared secret: %w", err)
 	}
 
+	transcript.appendShares(localPublicKey[:], remotePublicKey[:], initiator)
+
 	// Convert the resulting byte slice into a 32-byte array.
 	sharedSecretArray := new([KeySize]byte)
 	copy(sharedSecretArray[:], sharedSecret)
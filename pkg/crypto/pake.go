@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"filippo.io/edwards25519/field"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Domain separation labels for the CPace-style password-authenticated key exchange.
+const (
+	cpaceGeneratorLabel = "LanCrypt-CPace255-generator"
+	cpaceSessionLabel   = "LanCrypt-CPace255-ISK"
+)
+
+// PerformPAKE runs a CPace-style password-authenticated key exchange over X25519.
+// Both peers derive a secret generator point from the password, so only a peer that
+// knows the password ends up with the same key; an active attacker gets a single
+// online guess per run and learns nothing that helps an offline search.
+// The initiator flag must be set on exactly one side, it fixes the transcript order.
+// Both shares are also added to the handshake transcript.
+func PerformPAKE(conn net.Conn, password []byte, transcript *Transcript, initiator bool) (*[KeySize]byte, error) {
+	generator := passwordGenerator(password)
+
+	// --- Step 1: Pick an ephemeral scalar and compute our share on the secret generator ---
+	scalar := make([]byte, KeySize)
+	if _, err := rand.Read(scalar); err != nil {
+		return nil, fmt.Errorf("could not generate PAKE scalar: %w", err)
+	}
+	localShare, err := curve25519.X25519(scalar, generator)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute PAKE share: %w", err)
+	}
+
+	// --- Step 2: Swap shares with the peer ---
+	if _, err := conn.Write(localShare); err != nil {
+		return nil, fmt.Errorf("failed to send PAKE share: %w", err)
+	}
+	remoteShare := make([]byte, KeySize)
+	if _, err := io.ReadFull(conn, remoteShare); err != nil {
+		return nil, fmt.Errorf("failed to receive PAKE share: %w", err)
+	}
+
+	// --- Step 3: Compute the shared point ---
+	// X25519 rejects low-order points, which would otherwise force a known result.
+	point, err := curve25519.X25519(scalar, remoteShare)
+	if err != nil {
+		return nil, fmt.Errorf("peer sent an invalid PAKE share: %w", err)
+	}
+
+	transcript.appendShares(localShare, remoteShare, initiator)
+
+	// --- Step 4: Hash the point together with the transcript into the session key ---
+	first, second := localShare, remoteShare
+	if !initiator {
+		first, second = remoteShare, localShare
+	}
+	h := sha512.New()
+	writeLengthPrefixed(h, []byte(cpaceSessionLabel), point, first, second)
+
+	key := new([KeySize]byte)
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
+
+// passwordGenerator hashes the password onto Curve25519 with the Elligator 2 map,
+// returning the Montgomery u-coordinate of the generator point.
+func passwordGenerator(password []byte) []byte {
+	h := sha512.New()
+	writeLengthPrefixed(h, []byte(cpaceGeneratorLabel), password)
+
+	r, _ := new(field.Element).SetWideBytes(h.Sum(nil))
+	return elligator2(r).Bytes()
+}
+
+// elligator2 maps a field element to the u-coordinate of a Curve25519 point, following
+// map_to_curve_elligator2 from RFC 9380 with Z = 2. It runs in constant time.
+func elligator2(r *field.Element) *field.Element {
+	one := new(field.Element).One()
+	a := new(field.Element).Mult32(one, 486662)
+	negA := new(field.Element).Negate(a)
+
+	// tv1 = Z * r^2, with the exceptional case tv1 == -1 mapped to 0.
+	tv1 := new(field.Element).Square(r)
+	tv1.Add(tv1, tv1)
+	minusOne := new(field.Element).Negate(one)
+	tv1.Select(new(field.Element).Zero(), tv1, tv1.Equal(minusOne))
+
+	// x1 = -A / (1 + tv1)
+	x1 := new(field.Element).Add(tv1, one)
+	x1.Invert(x1)
+	x1.Multiply(x1, negA)
+
+	// gx1 = x1^3 + A*x1^2 + x1
+	gx1 := new(field.Element).Add(x1, a)
+	gx1.Multiply(gx1, x1)
+	gx1.Add(gx1, one)
+	gx1.Multiply(gx1, x1)
+
+	// x2 = -x1 - A
+	x2 := new(field.Element).Negate(x1)
+	x2.Subtract(x2, a)
+
+	_, isSquare := new(field.Element).SqrtRatio(gx1, one)
+	return new(field.Element).Select(x1, x2, isSquare)
+}
+
+// writeLengthPrefixed writes each field with its length, so that concatenated inputs
+// can never be ambiguous.
+func writeLengthPrefixed(w io.Writer, fields ...[]byte) {
+	var length [8]byte
+	for _, f := range fields {
+		binary.LittleEndian.PutUint64(length[:], uint64(len(f)))
+		w.Write(length[:])
+		w.Write(f)
+	}
+}
@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"net"
+	"slices"
+	"testing"
+
+	"filippo.io/edwards25519/field"
+)
+
+// feFromHex parses a field element written big-endian, as RFC 9380 prints them.
+func feFromHex(t *testing.T, s string) *field.Element {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(b)
+	fe, err := new(field.Element).SetBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fe
+}
+
+// TestElligator2Vectors checks the map against the edwards25519_XMD:SHA-512_ELL2_NU_
+// test vectors of RFC 9380. Those give the Edwards y-coordinate of the mapped point Q,
+// which the birational map ties to our Montgomery u-coordinate by u = (1+y)/(1-y).
+func TestElligator2Vectors(t *testing.T) {
+	vectors := []struct {
+		msg string
+		u   string // Field element the message hashes to.
+		qy  string // y-coordinate of map_to_curve(u) on edwards25519.
+	}{
+		{"empty", "7f3e7fb9428103ad7f52db32f9df32505d7b427d894c5093f7a0f0374a30641d", "22cb4aaa555e23bd460262d2130d6a3c9207aa8bbb85060928beb263d6d42a95"},
+		{"abc", "09cfa30ad79bd59456594a0f5d3a76f6b71c6787b04de98be5cd201a556e253b", "51b6f178eb08c4a782c820e306b82c6e273ab22e258d972cd0c511787b2a3443"},
+		{"abcdef0123456789", "475ccff99225ef90d78cc9338e9f6a6bb7b17607c0c4428937de75d33edba941", "5b9ea3c265ee42256a8f724f616307ef38496ef7eba391c08f99f3bea6fa88f0"},
+		{"q128_q...", "049a1c8bd51bcb2aec339f387d1ff51428b88d0763a91bcdf6929814ac95d03d", "5102353883d739bdc9f8a3af650342b171217167dcce34f8db57208ec1dfdbf2"},
+		{"a512_a...", "3cb0178a8137cefa5b79a3a57c858d7eeeaa787b2781be4a362a2f0750d24fa0", "38fb39f1566ca118ae6c7af42810c0bb9767ae5960abb5a8ca792530bfb9447d"},
+	}
+	one := new(field.Element).One()
+	for _, v := range vectors {
+		t.Run(v.msg, func(t *testing.T) {
+			y := feFromHex(t, v.qy)
+			num := new(field.Element).Add(one, y)
+			den := new(field.Element).Subtract(one, y)
+			want := num.Multiply(num, den.Invert(den))
+
+			if got := elligator2(feFromHex(t, v.u)); got.Equal(want) != 1 {
+				t.Errorf("elligator2(%s) = %x, want %x", v.u, got.Bytes(), want.Bytes())
+			}
+		})
+	}
+}
+
+// runPAKE runs both sides of the key exchange over a loopback connection. A pipe won't
+// do, since both sides send their share before reading the peer's.
+func runPAKE(t *testing.T, initiatorPassword, responderPassword string) (initiatorKey, responderKey *[KeySize]byte, initiatorTranscript, responderTranscript []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		key        *[KeySize]byte
+		transcript []byte
+		err        error
+	}
+	responder := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			responder <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		transcript := NewTranscript("test")
+		key, err := PerformPAKE(conn, []byte(responderPassword), transcript, false)
+		responder <- result{key, transcript.Sum(), err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	transcript := NewTranscript("test")
+	initiatorKey, err = PerformPAKE(conn, []byte(initiatorPassword), transcript, true)
+	if err != nil {
+		t.Fatalf("initiator: %v", err)
+	}
+	res := <-responder
+	if res.err != nil {
+		t.Fatalf("responder: %v", res.err)
+	}
+	return initiatorKey, res.key, transcript.Sum(), res.transcript
+}
+
+// TestPAKEKeysMatchOnlyWithSamePassword checks that both sides end up with one key when
+// they share the password, and with unrelated keys otherwise.
+func TestPAKEKeysMatchOnlyWithSamePassword(t *testing.T) {
+	tests := []struct {
+		name      string
+		initiator string
+		responder string
+		match     bool
+	}{
+		{"same password", "maple-otter-violin-harbor-482913", "maple-otter-violin-harbor-482913", true},
+		{"wrong suffix", "maple-otter-violin-harbor-482913", "maple-otter-violin-harbor-482914", false},
+		{"empty password", "", "maple-otter-violin-harbor-482913", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ik, rk, it, rt := runPAKE(t, tt.initiator, tt.responder)
+			if (*ik == *rk) != tt.match {
+				t.Errorf("keys equal = %v, want %v", *ik == *rk, tt.match)
+			}
+			// Both sides record the shares in the same order whatever the outcome.
+			if !slices.Equal(it, rt) {
+				t.Error("transcripts differ")
+			}
+		})
+	}
+}
+
+// TestPAKEKeysAreFresh checks that two runs with the same password give different keys.
+func TestPAKEKeysAreFresh(t *testing.T) {
+	first, _, _, _ := runPAKE(t, "code", "code")
+	second, _, _, _ := runPAKE(t, "code", "code")
+	if *first == *second {
+		t.Error("two runs derived the same key")
+	}
+}
@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the Argon2id cost parameters used to stretch a passphrase.
+type Argon2Params struct {
+	Time      uint32 // Number of passes over memory.
+	MemoryKiB uint32 // Memory used, in KiB.
+	Threads   uint8  // Degree of parallelism.
+}
+
+// Argon2ParamsSize is the size of Argon2Params on the wire.
+const Argon2ParamsSize = 9
+
+// DefaultArgon2Params follow the RFC 9106 recommendation for memory-constrained
+// environments, which a typical laptop handles in well under a second.
+var DefaultArgon2Params = Argon2Params{Time: 3, MemoryKiB: 64 * 1024, Threads: 4}
+
+// DefaultArgon2Limit is the most a peer may demand by default. Anything beyond it
+// could tie up a laptop for seconds, or exhaust its memory, before key confirmation
+// even shows that the peer knows the passphrase.
+var DefaultArgon2Limit = Argon2Params{Time: 10, MemoryKiB: 512 * 1024, Threads: 16}
+
+// Validate checks that the parameters are within sane bounds. The upper bounds also
+// stop a peer from demanding so much work that the handshake never finishes.
+func (p Argon2Params) Validate() error {
+	if p.Time < 1 || p.Time > 64 {
+		return fmt.Errorf("argon2 time must be between 1 and 64, got %d", p.Time)
+	}
+	if p.MemoryKiB < 8*1024 || p.MemoryKiB > 4*1024*1024 {
+		return fmt.Errorf("argon2 memory must be between 8 MiB and 4 GiB, got %d KiB", p.MemoryKiB)
+	}
+	if p.Threads < 1 || p.Threads > 64 {
+		return fmt.Errorf("argon2 threads must be between 1 and 64, got %d", p.Threads)
+	}
+	return nil
+}
+
+// Within checks that none of the parameters exceeds the corresponding limit.
+func (p Argon2Params) Within(limit Argon2Params) error {
+	if p.Time > limit.Time {
+		return fmt.Errorf("argon2 time of %d exceeds the limit of %d", p.Time, limit.Time)
+	}
+	if p.MemoryKiB > limit.MemoryKiB {
+		return fmt.Errorf("argon2 memory of %d MiB exceeds the limit of %d MiB", p.MemoryKiB/1024, limit.MemoryKiB/1024)
+	}
+	if p.Threads > limit.Threads {
+		return fmt.Errorf("argon2 threads of %d exceed the limit of %d", p.Threads, limit.Threads)
+	}
+	return nil
+}
+
+// Max returns the element-wise maximum of two parameter sets, so that neither peer can
+// weaken the cost the other one asked for.
+func (p Argon2Params) Max(q Argon2Params) Argon2Params {
+	return Argon2Params{
+		Time:      max(p.Time, q.Time),
+		MemoryKiB: max(p.MemoryKiB, q.MemoryKiB),
+		Threads:   max(p.Threads, q.Threads),
+	}
+}
+
+// MarshalBinary encodes the parameters for the handshake.
+func (p Argon2Params) MarshalBinary() ([]byte, error) {
+	b := make([]byte, Argon2ParamsSize)
+	binary.LittleEndian.PutUint32(b[0:], p.Time)
+	binary.LittleEndian.PutUint32(b[4:], p.MemoryKiB)
+	b[8] = p.Threads
+	return b, nil
+}
+
+// UnmarshalBinary decodes parameters received in the handshake.
+func (p *Argon2Params) UnmarshalBinary(b []byte) error {
+	if len(b) != Argon2ParamsSize {
+		return fmt.Errorf("invalid argon2 parameters length %d", len(b))
+	}
+	p.Time = binary.LittleEndian.Uint32(b[0:])
+	p.MemoryKiB = binary.LittleEndian.Uint32(b[4:])
+	p.Threads = b[8]
+	return nil
+}
+
+// String describes the parameters for display.
+func (p Argon2Params) String() string {
+	return fmt.Sprintf("t=%d, m=%d MiB, p=%d", p.Time, p.MemoryKiB/1024, p.Threads)
+}
+
+// StretchPassphrase runs the passphrase through Argon2id, so that every guess in an
+// offline attack costs the full memory-hard work factor. The salt must be unique to
+// the session, such as the handshake transcript hash.
+func StretchPassphrase(passphrase string, salt []byte, params Argon2Params) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, params.Time, params.MemoryKiB, params.Threads, KeySize)
+}
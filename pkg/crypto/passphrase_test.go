@@ -0,0 +1,26 @@
+package crypto
+
+import "testing"
+
+// TestArgon2ParamsWithin checks that every parameter is held to its own limit.
+func TestArgon2ParamsWithin(t *testing.T) {
+	limit := Argon2Params{Time: 10, MemoryKiB: 512 * 1024, Threads: 16}
+	tests := []struct {
+		name   string
+		params Argon2Params
+		ok     bool
+	}{
+		{"defaults", DefaultArgon2Params, true},
+		{"at the limit", limit, true},
+		{"too many passes", Argon2Params{Time: 11, MemoryKiB: 64 * 1024, Threads: 4}, false},
+		{"too much memory", Argon2Params{Time: 3, MemoryKiB: 4 * 1024 * 1024, Threads: 4}, false},
+		{"too many threads", Argon2Params{Time: 3, MemoryKiB: 64 * 1024, Threads: 64}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.params.Within(limit); (err == nil) != tt.ok {
+				t.Errorf("Within(%s) = %v, want ok=%v", tt.params, err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+)
+
+// ErrKeyMismatch is returned by ConfirmKeys when the peers derived different keys.
+var ErrKeyMismatch = errors.New("keys do not match: the passphrase or code differs, or the connection was tampered with")
+
+// Transcript accumulates everything exchanged during a handshake into a running hash.
+type Transcript struct {
+	h hash.Hash
+}
+
+// NewTranscript starts a transcript for the given protocol label.
+func NewTranscript(label string) *Transcript {
+	t := &Transcript{h: sha256.New()}
+	t.Append([]byte(label))
+	return t
+}
+
+// Append adds fields to the transcript. Every field is length-prefixed.
+func (t *Transcript) Append(fields ...[]byte) {
+	writeLengthPrefixed(t.h, fields...)
+}
+
+// appendShares adds both peers' key shares, always in initiator-responder order.
+func (t *Transcript) appendShares(local, remote []byte, initiator bool) {
+	if initiator {
+		t.Append(local, remote)
+	} else {
+		t.Append(remote, local)
+	}
+}
+
+// Sum returns the hash of the transcript so far.
+func (t *Transcript) Sum() []byte {
+	return t.h.Sum(nil)
+}
+
+// ConfirmKeys proves to the peer that we derived the same session keys, and checks the
+// peer's proof in turn. Each side sends a MAC over the transcript hash and its role, so
+// a wrong passphrase is reported here rather than as a failure to decrypt later on.
+func ConfirmKeys(conn net.Conn, keys *SessionKeys, transcript []byte, initiator bool) error {
+	local := confirmationMAC(keys, transcript, initiator)
+	if _, err := conn.Write(local); err != nil {
+		return fmt.Errorf("failed to send key confirmation: %w", err)
+	}
+
+	remote := make([]byte, len(local))
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return fmt.Errorf("failed to receive key confirmation: %w", err)
+	}
+	if !hmac.Equal(remote, confirmationMAC(keys, transcript, !initiator)) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// confirmationMAC computes the key-confirmation MAC for one role.
+func confirmationMAC(keys *SessionKeys, transcript []byte, initiator bool) []byte {
+	role := "responder"
+	if initiator {
+		role = "initiator"
+	}
+	mac := hmac.New(sha256.New, keys.Confirm[:])
+	writeLengthPrefixed(mac, []byte("LanCrypt key confirmation"), []byte(role), transcript)
+	return mac.Sum(nil)
+}
@@ -4,12 +4,41 @@ import (
 	"crypto/rand"
 	"fmt"
 	"math/big"
+	"strings"
 )
 
+// words holds 256 short, distinct words, so every word of a code adds 8 bits.
 var words = []string{
-	"apple", "banana", "carrot", "dog", "elephant", "frog", "grape", "hat", "ice",
-	"jungle", "kite", "lemon", "moon", "ninja", "orange", "pencil", "queen", "robot",
-	"snake", "tiger", "unicorn", "violet", "whale", "xylophone", "yacht", "zebra",
+	"acorn", "actor", "adult", "agent", "album", "alley", "amber", "angle", "ankle",
+	"anvil", "apple", "apron", "arena", "arrow", "atlas", "attic", "autumn", "badge",
+	"bagel", "baker", "bamboo", "banana", "banjo", "barn", "basil", "basket", "beach",
+	"beacon", "beaver", "bell", "bench", "berry", "bison", "blanket", "blossom", "boat",
+	"bonnet", "book", "bottle", "branch", "bread", "brick", "bridge", "brook", "broom",
+	"bubble", "bucket", "button", "cabin", "cactus", "camel", "camera", "candle", "canoe",
+	"canyon", "carpet", "carrot", "castle", "cedar", "cello", "chalk", "cherry", "chess",
+	"circus", "clock", "cloud", "clover", "cobra", "comet", "copper", "coral", "cotton",
+	"cousin", "coyote", "crayon", "cricket", "crystal", "curtain", "daisy", "dancer",
+	"delta", "desert", "diamond", "dinner", "dolphin", "donkey", "dragon", "drum",
+	"eagle", "earth", "easel", "echo", "elbow", "ember", "engine", "falcon", "feather",
+	"fern", "fiddle", "finch", "flame", "flute", "forest", "fossil", "fox", "galaxy",
+	"garden", "garlic", "geyser", "ginger", "giraffe", "glacier", "glove", "goose",
+	"grape", "guitar", "hammer", "harbor", "harp", "hazel", "hedge", "helmet", "heron",
+	"hippo", "honey", "hornet", "igloo", "island", "ivory", "jacket", "jaguar", "jelly",
+	"jewel", "jigsaw", "jungle", "kayak", "kettle", "kitten", "koala", "ladder", "lagoon",
+	"lantern", "lemon", "leopard", "lily", "lion", "lizard", "lobster", "locket", "lotus",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "mirror", "mitten", "monkey",
+	"moose", "mosaic", "muffin", "napkin", "nectar", "needle", "nest", "noodle", "nutmeg",
+	"oasis", "ocean", "olive", "onion", "orange", "orchid", "otter", "owl", "paddle",
+	"palace", "panda", "panther", "parrot", "peach", "peanut", "pebble", "pencil",
+	"pepper", "piano", "pickle", "pigeon", "pillow", "pine", "planet", "plum", "pocket",
+	"pony", "poppy", "potato", "pumpkin", "puzzle", "quail", "quartz", "quilt", "rabbit",
+	"radar", "radish", "raven", "ribbon", "river", "robin", "rocket", "saddle", "salmon",
+	"sandal", "satin", "scarf", "seal", "shadow", "shell", "silver", "sketch", "sparrow",
+	"spider", "spruce", "squash", "statue", "stone", "summit", "sunset", "swan", "tablet",
+	"tango", "teapot", "thunder", "tiger", "timber", "tomato", "topaz", "tractor",
+	"tulip", "tunnel", "turtle", "valley", "velvet", "violin", "volcano", "wagon",
+	"walnut", "walrus", "willow", "window", "wizard", "wolf", "yacht", "yogurt", "zebra",
+	"zephyr",
 }
 
 // GenerateCode creates a memorable, multi-word code.
@@ -27,4 +56,34 @@ func GenerateCode(numWords int) (string, error) {
 		code += words[n.Int64()]
 	}
 	return code, nil
-}
\ No newline at end of file
+}
+
+// GenerateSecret creates a numeric secret of the given length. It is appended to a
+// transfer code to form the PAKE password, but is never advertised on the network.
+func GenerateSecret(digits int) (string, error) {
+	secret := make([]byte, digits)
+	for i := range secret {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", fmt.Errorf("could not generate random number for secret: %w", err)
+		}
+		secret[i] = byte('0' + n.Int64())
+	}
+	return string(secret), nil
+}
+
+// SplitCode separates a full transfer code into the part that is advertised on the
+// network and the secret suffix, if any. Codes are made of words, so a final group of
+// digits can only be a secret.
+func SplitCode(code string) (public, secret string) {
+	i := strings.LastIndex(code, "-")
+	if i < 0 || i == len(code)-1 {
+		return code, ""
+	}
+	for _, c := range code[i+1:] {
+		if c < '0' || c > '9' {
+			return code, ""
+		}
+	}
+	return code[:i], code[i+1:]
+}